@@ -4,6 +4,7 @@ go 1.17
 
 require (
 	github.com/gorilla/websocket v1.4.2
+	github.com/pion/turn/v2 v2.0.6
 	github.com/pion/webrtc/v3 v3.1.17
 	github.com/suconghou/mediaindex v0.0.0-20210723142634-73696a6ddae7
 	github.com/suconghou/videoproxy v0.0.0-20211209095648-39e541fc0e0c
@@ -31,7 +32,6 @@ require (
 	github.com/pion/srtp/v2 v2.0.5 // indirect
 	github.com/pion/stun v0.3.5 // indirect
 	github.com/pion/transport v0.13.0 // indirect
-	github.com/pion/turn/v2 v2.0.6 // indirect
 	github.com/pion/udp v0.1.1 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.0 // indirect
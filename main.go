@@ -1,18 +1,25 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"syscall"
 	"time"
 	"videortc/proxy"
+	"videortc/request"
 	"videortc/route"
 	"videortc/rtc"
 	"videortc/util"
+	"videortc/video"
 	"videortc/ws"
 )
 
@@ -31,18 +38,22 @@ var sysStatus struct {
 	NumGoroutine int
 	CPUNum       int
 	Pid          int
+	Cache        map[string]*request.CacheStat // 内存缓存状态, index 索引数据, segment 媒体分段
 }
 
 func main() {
 	var (
-		port = flag.Int("p", 6060, "listen port")
-		host = flag.String("h", "", "bind address")
+		port  = flag.Int("p", 6060, "listen port")
+		host  = flag.String("h", "", "bind address")
+		grace = flag.Duration("g", time.Second*15, "graceful shutdown timeout")
 	)
 	flag.Parse()
-	util.Log.Fatal(serve(*host, *port))
+	if err := serve(*host, *port, *grace); err != nil {
+		util.Log.Fatal(err)
+	}
 }
 
-func serve(host string, port int) error {
+func serve(host string, port int, grace time.Duration) error {
 	var id = os.Getenv("ID")
 	var addr = os.Getenv("WS_ADDR")
 	if addr != "" || id != "" {
@@ -54,14 +65,44 @@ func serve(host string, port int) error {
 		}
 		go webrtcLoop(id, addr)
 		http.HandleFunc("/peers", peers)
+		http.HandleFunc("/bans", bans)
 	}
 	if os.Getenv("UPSTREAM") != "" {
 		http.HandleFunc("/video/", proxy.Handle)
 	}
 	http.HandleFunc("/", routeMatch)
 	http.HandleFunc("/status", status)
+	var server = &http.Server{Addr: fmt.Sprintf("%s:%d", host, port)}
+	var done = make(chan error, 1)
+	go func() {
+		done <- shutdown(server, grace)
+	}()
 	util.Log.Printf("Starting up on port %d", port)
-	return http.ListenAndServe(fmt.Sprintf("%s:%d", host, port), nil)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return <-done
+}
+
+// shutdown 收到SIGTERM/SIGINT后,先等待rtc任务在grace时间内完成并断开所有Peer,再关闭http服务
+func shutdown(server *http.Server, grace time.Duration) error {
+	var sig = make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	util.Log.Printf("Receive %s, shutting down", <-sig)
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if manager != nil {
+		if err := manager.Shutdown(ctx); err != nil {
+			util.Log.Print(err)
+		}
+	}
+	if err := video.FlushCache(); err != nil {
+		util.Log.Print(err)
+	}
+	// rtc任务可能已用完了grace时间,http服务另给一些时间
+	hctx, hcancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer hcancel()
+	return server.Shutdown(hctx)
 }
 
 func routeMatch(w http.ResponseWriter, r *http.Request) {
@@ -114,6 +155,10 @@ func status(w http.ResponseWriter, r *http.Request) {
 	sysStatus.GoVersion = runtime.Version()
 	sysStatus.Hostname, _ = os.Hostname()
 	sysStatus.Pid = os.Getpid()
+	sysStatus.Cache = map[string]*request.CacheStat{
+		"index":   request.CacheStats(),
+		"segment": video.CacheStats(),
+	}
 	util.JSONPut(w, sysStatus)
 }
 
@@ -125,6 +170,56 @@ func peers(w http.ResponseWriter, r *http.Request) {
 	util.JSONPut(w, manager.Stats())
 }
 
+// bans GET 查看封禁列表, POST ?id=xx&ttl=秒&reason=xx 封禁(ttl为0永久), DELETE ?id=xx 解除封禁
+// 未配置ADMIN_TOKEN时只能查看
+func bans(w http.ResponseWriter, r *http.Request) {
+	var query = r.URL.Query()
+	var token = os.Getenv("ADMIN_TOKEN")
+	switch r.Method {
+	case http.MethodGet, http.MethodPost, http.MethodDelete:
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if token == "" && r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if token != "" && !tokenEqual(query.Get("token"), token) && !tokenEqual(r.Header.Get("Authorization"), "Bearer "+token) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	var id = query.Get("id")
+	if r.Method != http.MethodGet && len(id) != 36 {
+		http.Error(w, "error id format", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		var ttl int
+		if s := query.Get("ttl"); s != "" {
+			var err error
+			if ttl, err = strconv.Atoi(s); err != nil || ttl < 0 {
+				http.Error(w, "error ttl", http.StatusBadRequest)
+				return
+			}
+		}
+		var reason = query.Get("reason")
+		if reason == "" {
+			reason = "admin"
+		}
+		manager.Ban(id, time.Second*time.Duration(ttl), reason)
+	case http.MethodDelete:
+		manager.Unban(id)
+	}
+	util.JSONPut(w, manager.Bans())
+}
+
+func tokenEqual(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
 func webrtcLoop(id string, addr string) {
 	manager = rtc.NewPeerManager()
 	var init = func(msg *ws.InitEvent) {
@@ -136,7 +231,7 @@ func webrtcLoop(id string, addr string) {
 			peer, created, err := manager.Ensure(online)
 			if err != nil {
 				util.Log.Print(err)
-				return
+				continue
 			}
 			if !created {
 				if err := peer.Ping(); err != nil {
@@ -0,0 +1,75 @@
+package request
+
+import (
+	"bytes"
+	"sync/atomic"
+)
+
+// Buffer 引用计数的只读数据,所有持有者都Release后底层缓冲区才放回缓存池
+// 缓存本身持有一个引用,每个使用者Acquire一个引用,使用完毕后Release
+type Buffer struct {
+	data []byte
+	buf  *bytes.Buffer // 来自缓存池,为nil时不需回收
+	refs int32
+}
+
+// NewBuffer 包装不来自缓存池的数据,初始持有一个引用
+func NewBuffer(bs []byte) *Buffer {
+	return &Buffer{
+		data: bs,
+		refs: 1,
+	}
+}
+
+func newPoolBuffer(b *bytes.Buffer) *Buffer {
+	return &Buffer{
+		data: b.Bytes(),
+		buf:  b,
+		refs: 1,
+	}
+}
+
+// Bytes 只读,Release之后不能再使用
+func (b *Buffer) Bytes() []byte {
+	return b.data
+}
+
+// Len 数据字节数
+func (b *Buffer) Len() int {
+	return len(b.data)
+}
+
+// Acquire 增加一个引用
+func (b *Buffer) Acquire() *Buffer {
+	atomic.AddInt32(&b.refs, 1)
+	return b
+}
+
+// tryAcquire 引用已归零(正在回收)时返回false
+func (b *Buffer) tryAcquire() bool {
+	for {
+		n := atomic.LoadInt32(&b.refs)
+		if n <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&b.refs, n, n+1) {
+			return true
+		}
+	}
+}
+
+// Release 释放一个引用,最后一个引用释放时回收底层缓冲区
+func (b *Buffer) Release() {
+	n := atomic.AddInt32(&b.refs, -1)
+	if n > 0 {
+		return
+	}
+	if n < 0 {
+		panic("request: Buffer released too many times")
+	}
+	if b.buf != nil {
+		putBuffer(b.buf)
+		b.buf = nil
+	}
+	b.data = nil
+}
@@ -0,0 +1,92 @@
+package request
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBufferRefs(t *testing.T) {
+	var b = newPoolBuffer(bytes.NewBufferString("hello"))
+	if b.Acquire() != b || !b.tryAcquire() {
+		t.Fatal("acquire failed")
+	}
+	b.Release()
+	b.Release()
+	if b.Len() != 5 {
+		t.Fatalf("len %d after partial release", b.Len())
+	}
+	b.Release()
+	if b.tryAcquire() {
+		t.Fatal("acquired a recycled buffer")
+	}
+	if b.Bytes() != nil {
+		t.Fatal("data kept after recycle")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("release below zero did not panic")
+		}
+	}()
+	b.Release()
+}
+
+func TestGetSegmentSizeMismatch(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	var l = NewLockGeter(time.Minute, 1<<20)
+	b, err := l.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Release()
+	// 已缓存的数据长度与预期不符,不能返回,也不能多持有或少释放引用
+	if _, _, err = l.GetSegment(&Target{URL: server.URL, Size: 4}); err == nil {
+		t.Fatal("size mismatch not detected")
+	}
+	v, ok := l.caches.Load(server.URL)
+	if !ok {
+		t.Fatal("cache item removed")
+	}
+	if refs := v.(*cacheItem).data.refs; refs != 1 {
+		t.Fatalf("refs %d, expected 1 held by cache", refs)
+	}
+	b, _, err = l.GetSegment(&Target{URL: server.URL, Size: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b.Bytes()) != "hello" {
+		t.Fatalf("data %q", b.Bytes())
+	}
+	b.Release()
+}
+
+func TestCacheEvictKeepsAcquired(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte(r.URL.Path[1:]), 30000))
+	}))
+	defer server.Close()
+	// 容量只够一个条目
+	var l = NewLockGeter(time.Minute, 40*1024)
+	a, err := l.Get(server.URL + "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := l.Get(server.URL + "/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Release()
+	if st := l.Stats(); st.Evictions == 0 {
+		t.Fatalf("stats %+v, expected an eviction", st)
+	}
+	// 被淘汰的数据在调用方Release之前仍然可用
+	if !bytes.Equal(a.Bytes(), bytes.Repeat([]byte("a"), 30000)) {
+		t.Fatal("evicted data changed before release")
+	}
+	a.Release()
+}
@@ -3,10 +3,13 @@ package request
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	vutil "github.com/suconghou/videoproxy/util"
@@ -28,81 +31,328 @@ var (
 	errTimeout = errors.New("timeout")
 )
 
+const (
+	// 超过此大小的缓冲区不放回缓存池,避免缓存池持有过多内存
+	maxPoolBuffer = 4 * 1024 * 1024
+	// 请求失败的结果缓存的时间
+	errCache = time.Second * 5
+)
+
 // LockGeter for http cache & lock get
+// 缓存总字节数不超过max,超出时综合访问次数和最近访问时间淘汰
 type LockGeter struct {
-	time   time.Time
-	cache  time.Duration
-	caches sync.Map
+	time      time.Time
+	cache     time.Duration
+	max       int64
+	size      int64
+	hits      uint64
+	miss      uint64
+	evictions uint64
+	caches    sync.Map
+	lock      *sync.Mutex
 }
 
 type cacheItem struct {
 	time   time.Time
 	ctx    context.Context
 	cancel context.CancelFunc
-	data   *bytes.Buffer
+	data   *Buffer
+	sum    string // 数据的sha256
 	err    error
+	size   int64   // 占用的内存,下载完成后才计入
+	sized  bool    // size已计入LockGeter.size并且缓存持有data的引用,由LockGeter.lock保护
+	stream *stream // 长度已知时边下载边读取
+	done   int32
+	hits   uint64
+	atime  int64 // 最近访问时间,UnixNano
 }
 
-// NewLockGeter create new lockgeter
-func NewLockGeter(cache time.Duration) *LockGeter {
+// CacheStat for cache status
+type CacheStat struct {
+	Items     int
+	Bytes     int64
+	Max       int64
+	Hits      uint64
+	Miss      uint64
+	Evictions uint64
+}
+
+// NewLockGeter create new lockgeter, cache为缓存的最长时间, max为缓存的最大字节数
+func NewLockGeter(cache time.Duration, max int64) *LockGeter {
 	return &LockGeter{
 		time:   time.Now(),
 		cache:  cache,
+		max:    max,
 		caches: sync.Map{},
+		lock:   &sync.Mutex{},
+	}
+}
+
+// Get with lock & cache,the return buffer is readonly, 使用完毕后需Release
+func (l *LockGeter) Get(url string) (*Buffer, error) {
+	b, _, err := l.get(url, -1)
+	return b, err
+}
+
+// GetSegment 获取媒体分段,长度与索引中的范围不符的数据不会返回,同时返回数据的sha256, 使用完毕后需Release
+func (l *LockGeter) GetSegment(t *Target) (*Buffer, string, error) {
+	return l.get(t.URL, t.Size)
+}
+
+// Sum 获取已缓存数据的sha256,未缓存或还未下载完成返回空
+func (l *LockGeter) Sum(url string) string {
+	t, ok := l.caches.Load(url)
+	if !ok {
+		return ""
+	}
+	v := t.(*cacheItem)
+	select {
+	case <-v.ctx.Done():
+		if v.data == nil {
+			return ""
+		}
+		return v.sum
+	default:
+		return ""
 	}
 }
 
-// Get with lock & cache,the return bytes is readonly
-func (l *LockGeter) Get(url string) ([]byte, error) {
+// size 为预期的数据长度,小于0则不校验,返回的Buffer已持有一个引用
+func (l *LockGeter) get(url string, size int) (*Buffer, string, error) {
+	v, loaded := l.load(url, size)
+	if v.stream != nil {
+		// 等待期间计入读取者,避免其他读取者都离开时中止下载
+		if !v.stream.attach() {
+			<-v.ctx.Done()
+			return l.get(url, size)
+		}
+		defer v.stream.detach()
+	}
+	if !loaded {
+		l.fetch(url, v)
+	}
+	<-v.ctx.Done()
+	if v.data == nil {
+		return nil, "", v.err
+	}
+	// 先持有引用再读取长度,否则数据可能恰好被回收复用
+	if !v.data.tryAcquire() {
+		// 恰好已被淘汰回收,重新获取
+		return l.get(url, size)
+	}
+	if n := v.data.Len(); size >= 0 && n != size {
+		v.data.Release()
+		return nil, "", fmt.Errorf("%s: size %d, expected %d", url, n, size)
+	}
+	return v.data, v.sum, nil
+}
+
+// Stream 获取媒体分段,无需等待下载完成即可读取已到达的数据,同时请求此分段的调用方共享同一个下载
+func (l *LockGeter) Stream(t *Target) (*Stream, error) {
+	v, loaded := l.load(t.URL, t.Size)
+	if v.stream != nil {
+		if !v.stream.attach() {
+			// 之前的读取者都已离开,下载已中止,等待其从缓存中移除后重新获取
+			<-v.ctx.Done()
+			return l.Stream(t)
+		}
+		// 返回前持有引用,之后缓存淘汰此数据也不影响读取
+		b, ok := v.stream.acquire()
+		if !ok {
+			// 恰好已被淘汰回收,重新获取
+			v.stream.detach()
+			return l.Stream(t)
+		}
+		if !loaded {
+			go l.fetch(t.URL, v)
+		}
+		return &Stream{s: v.stream, buf: b, fetched: !loaded}, nil
+	}
+	if !loaded {
+		go l.fetch(t.URL, v)
+	}
+	// 由Get创建的缓存项没有stream,等待其下载完成
+	b, sum, err := l.get(t.URL, t.Size)
+	if err != nil {
+		return nil, err
+	}
+	return NewBufferStream(b, sum), nil
+}
+
+// load 获取缓存项,不存在时新建,返回是否已存在; size已知时新建的缓存项可边下载边读取
+func (l *LockGeter) load(url string, size int) (*cacheItem, bool) {
 	var now = time.Now()
 	l.clean(now)
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-	t, loaded := l.caches.LoadOrStore(url, &cacheItem{
+	var item = &cacheItem{
 		time:   now,
 		ctx:    ctx,
 		cancel: cancel,
 		err:    errTimeout,
-	})
+	}
+	if size >= 0 {
+		item.stream = newStream(size)
+	}
+	t, loaded := l.caches.LoadOrStore(url, item)
 	v := t.(*cacheItem)
+	atomic.StoreInt64(&v.atime, now.UnixNano())
 	if loaded {
-		<-v.ctx.Done()
-		if v.data == nil {
-			return nil, v.err
+		cancel()
+		atomic.AddUint64(&l.hits, 1)
+		atomic.AddUint64(&v.hits, 1)
+	} else {
+		atomic.AddUint64(&l.miss, 1)
+	}
+	return v, loaded
+}
+
+// fetch 下载数据并填充缓存项,下载成功后缓存持有数据的一个引用
+func (l *LockGeter) fetch(url string, v *cacheItem) {
+	var (
+		b   *Buffer
+		sum string
+		err error
+	)
+	if v.stream != nil {
+		b, sum, err = v.stream.download(url)
+	} else {
+		b, sum, err = download(url)
+	}
+	if err != nil {
+		v.err = err
+		atomic.StoreInt32(&v.done, 1)
+		if errors.Is(err, errAborted) {
+			// 中止的下载不缓存,之后的请求重新获取
+			l.lock.Lock()
+			if t, ok := l.caches.Load(url); ok && t == v {
+				l.remove(url)
+			}
+			l.lock.Unlock()
 		}
-		return v.data.Bytes(), v.err
+		v.cancel()
+		return
 	}
-	data, err := Get(url)
-	v.data = data
-	v.err = err
-	cancel()
-	if data == nil {
-		return nil, err
+	v.sum = sum
+	v.size = int64(b.buf.Cap())
+	v.data = b
+	v.err = nil
+	atomic.StoreInt32(&v.done, 1)
+	v.cancel()
+	l.lock.Lock()
+	if t, ok := l.caches.Load(url); ok && t == v {
+		v.sized = true
+		l.size += v.size
+		l.evict(time.Now())
+	} else {
+		// 下载期间已被清理,缓存不再持有
+		b.Release()
+	}
+	l.lock.Unlock()
+}
+
+// evict 超出max时淘汰分数最低的,分数为访问次数除以距最近访问的秒数,需持有锁
+func (l *LockGeter) evict(now time.Time) {
+	for l.size > l.max {
+		var (
+			victim interface{}
+			score  float64
+		)
+		l.caches.Range(func(key, value interface{}) bool {
+			var v = value.(*cacheItem)
+			if atomic.LoadInt32(&v.done) == 0 || v.data == nil {
+				return true
+			}
+			var idle = now.Sub(time.Unix(0, atomic.LoadInt64(&v.atime))).Seconds()
+			var s = float64(atomic.LoadUint64(&v.hits)+1) / (idle + 1)
+			if victim == nil || s < score {
+				victim, score = key, s
+			}
+			return true
+		})
+		if victim == nil {
+			return
+		}
+		l.remove(victim)
+		atomic.AddUint64(&l.evictions, 1)
+	}
+}
+
+// remove 移除缓存项,需持有锁
+func (l *LockGeter) remove(key interface{}) {
+	t, ok := l.caches.LoadAndDelete(key)
+	if !ok {
+		return
 	}
-	return data.Bytes(), err
+	var v = t.(*cacheItem)
+	v.cancel()
+	if !v.sized {
+		return
+	}
+	v.sized = false
+	l.size -= v.size
+	// 释放缓存的引用,正在使用此数据的调用方都Release后才会回收
+	v.data.Release()
 }
 
 func (l *LockGeter) clean(now time.Time) {
 	if now.Sub(l.time) < time.Second*5 {
 		return
 	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
 	l.caches.Range(func(key, value interface{}) bool {
 		var v = value.(*cacheItem)
-		if now.Sub(v.time) > l.cache {
-			v.cancel()
-			if v.data != nil {
-				v.data.Reset()
-				bufferPool.Put(v.data)
-			}
-			l.caches.Delete(key)
+		var age = now.Sub(v.time)
+		if age > l.cache || (age > errCache && atomic.LoadInt32(&v.done) == 1 && v.data == nil) {
+			l.remove(key)
 		}
 		return true
 	})
 	l.time = now
 }
 
-// Get http data, the return value should be readonly
-func Get(url string) (*bytes.Buffer, error) {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+// Stats output cache status
+func (l *LockGeter) Stats() *CacheStat {
+	var n = 0
+	l.caches.Range(func(key, value interface{}) bool {
+		n++
+		return true
+	})
+	l.lock.Lock()
+	var size = l.size
+	l.lock.Unlock()
+	return &CacheStat{
+		Items:     n,
+		Bytes:     size,
+		Max:       l.max,
+		Hits:      atomic.LoadUint64(&l.hits),
+		Miss:      atomic.LoadUint64(&l.miss),
+		Evictions: atomic.LoadUint64(&l.evictions),
+	}
+}
+
+// putBuffer 放回缓存池,过大的缓冲区直接丢弃
+func putBuffer(b *bytes.Buffer) {
+	if b.Cap() > maxPoolBuffer {
+		return
+	}
+	b.Reset()
+	bufferPool.Put(b)
+}
+
+// download 下载长度未知的数据,返回的Buffer持有一个引用
+func download(url string) (*Buffer, string, error) {
+	data, err := Get(url)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(data.Bytes())
+	return newPoolBuffer(data), hex.EncodeToString(sum[:]), nil
+}
+
+// open 发起请求,状态码不是200时返回错误
+func open(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -111,16 +361,25 @@ func Get(url string) (*bytes.Buffer, error) {
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
 		return nil, fmt.Errorf("%s:%s", url, resp.Status)
 	}
+	return resp, nil
+}
+
+// Get http data, the return value should be readonly
+func Get(url string) (*bytes.Buffer, error) {
+	resp, err := open(context.Background(), url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 	var buffer = bufferPool.Get().(*bytes.Buffer)
 	buffer.Reset()
 	_, err = buffer.ReadFrom(resp.Body)
 	if err != nil {
-		buffer.Reset()
-		bufferPool.Put(buffer)
+		putBuffer(buffer)
 		return nil, err
 	}
 	return buffer, nil
@@ -17,7 +17,7 @@ import (
 
 var (
 	infoMapCache sync.Map
-	httpProvider = NewLockGeter(time.Second * 5)
+	httpProvider = NewLockGeter(time.Second*5, 16*1024*1024)
 	baseURL      = os.Getenv("BASE_URL")
 )
 
@@ -26,6 +26,17 @@ type infoItem struct {
 	data map[int][2]uint64
 }
 
+// CacheStats 索引数据的缓存状态
+func CacheStats() *CacheStat {
+	return httpProvider.Stats()
+}
+
+// Target 媒体分段的下载地址和字节数
+type Target struct {
+	URL  string
+	Size int
+}
+
 func cacheGet(key string) map[int][2]uint64 {
 	v, ok := infoMapCache.Load(key)
 	if ok {
@@ -50,22 +61,63 @@ func cacheSet(key string, val map[int][2]uint64) {
 }
 
 // GetIndex parseIndex with cache and return this segment download url
-func GetIndex(vid string, item *youtubevideoparser.StreamItem, index int) (string, error) {
+func GetIndex(vid string, item *youtubevideoparser.StreamItem, index int) (*Target, error) {
+	ranges, err := getRanges(vid, item)
+	if err != nil {
+		return nil, err
+	}
+	target := getTarget(vid, item, ranges, index)
+	if target == nil {
+		return nil, fmt.Errorf("%s:%s error get %d index range", vid, item.Itag, index)
+	}
+	return target, nil
+}
+
+// GetIndexes 批量获取分段的下载地址,不存在的分段对应位置为nil
+func GetIndexes(vid string, item *youtubevideoparser.StreamItem, indexes []uint64) ([]*Target, error) {
+	ranges, err := getRanges(vid, item)
+	if err != nil {
+		return nil, err
+	}
+	var res = make([]*Target, len(indexes))
+	for i, index := range indexes {
+		res[i] = getTarget(vid, item, ranges, int(index))
+	}
+	return res, nil
+}
+
+func getRanges(vid string, item *youtubevideoparser.StreamItem) (map[int][2]uint64, error) {
 	var key = fmt.Sprintf("%s:%s", vid, item.Itag)
 	ranges := cacheGet(key)
 	if ranges == nil {
 		var err error
 		ranges, err = parseIndex(vid, item)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 		cacheSet(key, ranges)
 	}
+	return ranges, nil
+}
+
+// CachedIndex 同GetIndex,但只使用已解析的索引,未解析过返回nil
+func CachedIndex(vid string, item *youtubevideoparser.StreamItem, index int) *Target {
+	ranges := cacheGet(fmt.Sprintf("%s:%s", vid, item.Itag))
+	if ranges == nil {
+		return nil
+	}
+	return getTarget(vid, item, ranges, index)
+}
+
+func getTarget(vid string, item *youtubevideoparser.StreamItem, ranges map[int][2]uint64, index int) *Target {
 	info := ranges[index]
 	if info[1] == 0 {
-		return "", fmt.Errorf("%s:%s error get %d index range", vid, item.Itag, index)
+		return nil
+	}
+	return &Target{
+		URL:  getData(vid, item.Itag, int(info[0]), int(info[1]), item),
+		Size: int(info[1] - info[0]),
 	}
-	return getData(vid, item.Itag, int(info[0]), int(info[1]), item), nil
 }
 
 // parse item media
@@ -79,10 +131,12 @@ func parseIndex(vid string, item *youtubevideoparser.StreamItem) (map[int][2]uin
 		return nil, err
 	}
 	var indexURL = getData(vid, item.Itag, start, end+1, item)
-	bs, err := httpProvider.Get(indexURL)
+	buf, err := httpProvider.Get(indexURL)
 	if err != nil {
 		return nil, err
 	}
+	defer buf.Release()
+	var bs = buf.Bytes()
 	util.Log.Printf("Parse %s %d", indexURL, len(bs))
 	var indexEndOffset uint64
 	indexEndOffset, err = strconv.ParseUint(item.IndexRange.End, 10, 64)
@@ -119,11 +173,12 @@ func getByOrigin(item *youtubevideoparser.StreamItem, start int, end int) string
 // GetInfoByUpstream 媒体索引也用upstream
 func GetInfoByUpstream(baseURL string, vid string) (*youtubevideoparser.VideoInfo, error) {
 	var url = fmt.Sprintf("%s/%s.json", baseURL, vid)
-	bs, err := httpProvider.Get(url)
+	buf, err := httpProvider.Get(url)
 	if err != nil {
 		return nil, err
 	}
+	defer buf.Release()
 	var data *youtubevideoparser.VideoInfo
-	err = json.Unmarshal(bs, &data)
+	err = json.Unmarshal(buf.Bytes(), &data)
 	return data, err
 }
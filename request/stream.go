@@ -0,0 +1,286 @@
+package request
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var (
+	errRecycled = errors.New("buffer recycled")
+	errAborted  = errors.New("download aborted")
+)
+
+// stream 已知长度的下载,数据写入预先分配好的缓冲区,读取者可在下载过程中读取已到达的部分
+// 所有读取者都离开后中止下载
+type stream struct {
+	total   int
+	n       int     // 已到达的字节数
+	buf     *Buffer // 开始接收数据后才有
+	sum     string
+	err     error
+	done    bool
+	readers int  // 正在使用此下载的读取者数量
+	aborted bool // 读取者都已离开,下载已中止,不能再加入
+	held    bool // 有读取者时stream持有buf的一个引用,下载完成后缓存即使淘汰了此数据,之前加入的读取者仍可获取
+	ctx     context.Context
+	cancel  context.CancelFunc
+	lock    *sync.Mutex
+	cond    *sync.Cond
+}
+
+// Stream 读取正在下载或已下载完成的数据,同一URL的所有读取者共享一个下载, 使用完毕后需Release
+type Stream struct {
+	s        *stream
+	buf      *Buffer // 此读取者持有的引用
+	observer bool    // 不计入读取者,不会让下载继续
+	fetched  bool    // 此读取者发起了上游下载
+}
+
+func newStream(total int) *stream {
+	var lock = &sync.Mutex{}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &stream{
+		total:  total,
+		ctx:    ctx,
+		cancel: cancel,
+		lock:   lock,
+		cond:   sync.NewCond(lock),
+	}
+}
+
+// NewBufferStream 包装已完整的数据,b的引用转交给返回的Stream
+func NewBufferStream(b *Buffer, sum string) *Stream {
+	var s = newStream(b.Len())
+	s.n = s.total
+	s.buf = b
+	s.sum = sum
+	s.done = true
+	s.readers = 1
+	return &Stream{s: s, buf: b}
+}
+
+// attach 加入一个读取者,下载已因没有读取者而中止时返回false
+func (s *stream) attach() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.aborted {
+		return false
+	}
+	s.readers++
+	return true
+}
+
+// acquire 数据缓冲区已分配时为读取者持有一个引用,已被回收时返回false
+func (s *stream) acquire() (*Buffer, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.buf == nil {
+		return nil, true
+	}
+	if !s.buf.tryAcquire() {
+		return nil, false
+	}
+	return s.buf, true
+}
+
+// detach 离开一个读取者,最后一个读取者离开时中止未完成的下载,并释放stream持有的引用
+func (s *stream) detach() {
+	var held *Buffer
+	s.lock.Lock()
+	s.readers--
+	var abort = s.readers <= 0 && !s.done
+	if abort {
+		s.aborted = true
+	}
+	if s.readers <= 0 && s.held {
+		s.held = false
+		held = s.buf
+	}
+	s.lock.Unlock()
+	if abort {
+		s.cancel()
+	}
+	if held != nil {
+		held.Release()
+	}
+}
+
+// download 边下载边通知读取者,长度与total不符时返回错误;成功时返回的Buffer持有一个引用
+func (s *stream) download(url string) (*Buffer, string, error) {
+	defer s.cancel()
+	resp, err := open(s.ctx, url)
+	if err != nil {
+		if s.ctx.Err() != nil {
+			err = errAborted
+		}
+		s.finish("", err)
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	var b = bufferPool.Get().(*bytes.Buffer)
+	b.Reset()
+	b.Grow(s.total)
+	// 只在已写入的范围之后写入,读取者读取的部分不会再被修改
+	var buf = &Buffer{
+		data: b.Bytes()[:s.total],
+		buf:  b,
+		refs: 1,
+	}
+	s.lock.Lock()
+	s.buf = buf
+	if s.readers > 0 {
+		buf.refs++
+		s.held = true
+	}
+	s.cond.Broadcast()
+	s.lock.Unlock()
+	var (
+		h = sha256.New()
+		n int
+		m int
+	)
+	for n < s.total && err == nil {
+		m, err = resp.Body.Read(buf.data[n:])
+		h.Write(buf.data[n : n+m])
+		n += m
+		s.lock.Lock()
+		s.n = n
+		s.cond.Broadcast()
+		s.lock.Unlock()
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	if s.ctx.Err() != nil {
+		err = errAborted
+	}
+	if err == nil {
+		// 继续读取一个字节,确认数据没有超出预期的长度
+		var extra [1]byte
+		if m, _ = io.ReadFull(resp.Body, extra[:]); n != s.total || m > 0 {
+			err = fmt.Errorf("%s: size %d, expected %d", url, n+m, s.total)
+		}
+	}
+	if err != nil {
+		s.finish("", err)
+		buf.Release()
+		return nil, "", err
+	}
+	var sum = hex.EncodeToString(h.Sum(nil))
+	s.finish(sum, nil)
+	return buf, sum, nil
+}
+
+func (s *stream) finish(sum string, err error) {
+	s.lock.Lock()
+	s.sum = sum
+	s.err = err
+	s.done = true
+	s.cond.Broadcast()
+	s.lock.Unlock()
+}
+
+// Total 数据总字节数
+func (r *Stream) Total() int {
+	return r.s.total
+}
+
+// Read 返回[start,end)的数据,阻塞直到这部分数据到达或ctx取消;读取到末尾时会等待下载完成并校验长度,返回的数据只读
+func (r *Stream) Read(ctx context.Context, start int, end int) ([]byte, error) {
+	var (
+		s     = r.s
+		watch chan struct{}
+	)
+	defer func() {
+		if watch != nil {
+			close(watch)
+		}
+	}()
+	s.lock.Lock()
+	for {
+		if s.err != nil {
+			s.lock.Unlock()
+			return nil, s.err
+		}
+		if err := ctx.Err(); err != nil {
+			s.lock.Unlock()
+			return nil, err
+		}
+		if r.buf == nil && s.buf != nil {
+			if !s.buf.tryAcquire() {
+				s.lock.Unlock()
+				return nil, errRecycled
+			}
+			r.buf = s.buf
+		}
+		if r.buf != nil && s.n >= end && (end < s.total || s.done) {
+			break
+		}
+		if watch == nil && ctx.Done() != nil {
+			// ctx取消时唤醒等待
+			watch = make(chan struct{})
+			go s.wake(ctx, watch)
+		}
+		s.cond.Wait()
+	}
+	s.lock.Unlock()
+	return r.buf.data[start:end], nil
+}
+
+func (s *stream) wake(ctx context.Context, done chan struct{}) {
+	select {
+	case <-ctx.Done():
+		s.lock.Lock()
+		s.cond.Broadcast()
+		s.lock.Unlock()
+	case <-done:
+	}
+}
+
+// All 等待下载完成,返回全部数据和其sha256
+func (r *Stream) All(ctx context.Context) ([]byte, string, error) {
+	bs, err := r.Read(ctx, 0, r.s.total)
+	if err != nil {
+		return nil, "", err
+	}
+	return bs, r.Sum(), nil
+}
+
+// Sum 下载完成后数据的sha256,未完成时返回空
+func (r *Stream) Sum() string {
+	r.s.lock.Lock()
+	defer r.s.lock.Unlock()
+	return r.s.sum
+}
+
+// Fetched 此读取者是否发起了上游下载,即数据因此次请求进入缓存
+func (r *Stream) Fetched() bool {
+	return r.fetched
+}
+
+// Observe 同一数据的旁观者,可等待下载完成后读取,但不计入读取者,读取者都离开后下载仍会中止;同样需要Release
+func (r *Stream) Observe() *Stream {
+	var c = &Stream{s: r.s, observer: true}
+	if r.buf != nil {
+		c.buf = r.buf.Acquire()
+	}
+	return c
+}
+
+// Release 释放此读取者持有的引用
+func (r *Stream) Release() {
+	if r.buf != nil {
+		r.buf.Release()
+		r.buf = nil
+	}
+	if r.s != nil && !r.observer {
+		r.s.detach()
+	}
+	r.s = nil
+}
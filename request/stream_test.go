@@ -0,0 +1,282 @@
+package request
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stallServer 先发送head,收到release后再发送tail;请求被客户端中止时通知aborted
+type stallServer struct {
+	*httptest.Server
+	release  chan struct{}
+	aborted  chan struct{}
+	requests int32
+}
+
+func newStallServer(head []byte, tail []byte) *stallServer {
+	var s = &stallServer{
+		release: make(chan struct{}),
+		aborted: make(chan struct{}, 10),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.requests, 1)
+		w.Write(head)
+		w.(http.Flusher).Flush()
+		select {
+		case <-s.release:
+			w.Write(tail)
+		case <-r.Context().Done():
+			s.aborted <- struct{}{}
+		}
+	}))
+	return s
+}
+
+func TestStreamRead(t *testing.T) {
+	var (
+		head = bytes.Repeat([]byte{1}, 1000)
+		tail = bytes.Repeat([]byte{2}, 500)
+		data = append(append([]byte{}, head...), tail...)
+		s    = newStallServer(head, tail)
+		l    = NewLockGeter(time.Minute, 1<<20)
+		ctx  = context.Background()
+	)
+	defer s.Close()
+	st, err := l.Stream(&Target{URL: s.URL, Size: len(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Release()
+	if st.Total() != len(data) {
+		t.Fatalf("total %d", st.Total())
+	}
+	// 已到达的部分无需等待下载完成
+	bs, err := st.Read(ctx, 0, len(head))
+	if err != nil || !bytes.Equal(bs, head) {
+		t.Fatalf("read head %v", err)
+	}
+	if st.Sum() != "" {
+		t.Fatal("sum before download done")
+	}
+	close(s.release)
+	bs, sum, err := st.All(ctx)
+	if err != nil || !bytes.Equal(bs, data) {
+		t.Fatalf("read all %v", err)
+	}
+	var expected = sha256.Sum256(data)
+	if sum != hex.EncodeToString(expected[:]) {
+		t.Fatalf("sum %s", sum)
+	}
+	// 同一URL共享下载
+	b, _, err := l.GetSegment(&Target{URL: s.URL, Size: len(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Release()
+	if n := atomic.LoadInt32(&s.requests); n != 1 {
+		t.Fatalf("requests %d, expected 1", n)
+	}
+}
+
+func TestStreamReadCanceled(t *testing.T) {
+	var (
+		s = newStallServer([]byte("head"), []byte("tail"))
+		l = NewLockGeter(time.Minute, 1<<20)
+	)
+	defer s.Close()
+	defer close(s.release)
+	st, err := l.Stream(&Target{URL: s.URL, Size: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*50, cancel)
+	var start = time.Now()
+	if _, err = st.Read(ctx, 0, 8); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err %v, expected canceled", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("read returned after %s", d)
+	}
+	// 唯一的读取者离开后下载中止
+	st.Release()
+	select {
+	case <-s.aborted:
+	case <-time.After(time.Second * 5):
+		t.Fatal("download not aborted")
+	}
+	// 中止的下载不缓存,再次请求重新下载
+	st, err = l.Stream(&Target{URL: s.URL, Size: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Release()
+	if _, err = st.Read(context.Background(), 0, 4); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&s.requests); n != 2 {
+		t.Fatalf("requests %d, expected 2", n)
+	}
+}
+
+func TestStreamObserver(t *testing.T) {
+	var (
+		s = newStallServer([]byte("head"), []byte("tail"))
+		l = NewLockGeter(time.Minute, 1<<20)
+	)
+	defer s.Close()
+	defer close(s.release)
+	st, err := l.Stream(&Target{URL: s.URL, Size: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var o = st.Observe()
+	defer o.Release()
+	var done = make(chan error, 1)
+	go func() {
+		_, _, err := o.All(context.Background())
+		done <- err
+	}()
+	// 旁观者不会让下载继续
+	st.Release()
+	select {
+	case err = <-done:
+		if !errors.Is(err, errAborted) {
+			t.Fatalf("err %v, expected aborted", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("observer not woken after abort")
+	}
+}
+
+func TestStreamKeptByGet(t *testing.T) {
+	var (
+		s = newStallServer([]byte("head"), []byte("tail"))
+		l = NewLockGeter(time.Minute, 1<<20)
+	)
+	defer s.Close()
+	st, err := l.Stream(&Target{URL: s.URL, Size: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var done = make(chan error, 1)
+	go func() {
+		b, _, err := l.GetSegment(&Target{URL: s.URL, Size: 8})
+		if err == nil {
+			b.Release()
+		}
+		done <- err
+	}()
+	// 等待GetSegment加入后,流的读取者离开,下载仍需继续
+	for i := 0; i < 100; i++ {
+		st.s.lock.Lock()
+		var readers = st.s.readers
+		st.s.lock.Unlock()
+		if readers == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	st.Release()
+	close(s.release)
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("get not finished")
+	}
+}
+
+func TestStreamEvictedBeforeRead(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	var l = NewLockGeter(time.Minute, 1<<20)
+	b, _, err := l.GetSegment(&Target{URL: server.URL, Size: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Release()
+	st, err := l.Stream(&Target{URL: server.URL, Size: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Release()
+	// Stream返回之后、读取之前被淘汰,已持有的引用保证数据仍可读取
+	l.lock.Lock()
+	l.remove(server.URL)
+	l.lock.Unlock()
+	bs, err := st.Read(context.Background(), 0, 5)
+	if err != nil || string(bs) != "hello" {
+		t.Fatalf("read %q %v", bs, err)
+	}
+}
+
+func TestStreamEvictedWhileDownloading(t *testing.T) {
+	var (
+		s = newStallServer([]byte("head"), []byte("tail"))
+		l = NewLockGeter(time.Minute, 1<<20)
+	)
+	defer s.Close()
+	st, err := l.Stream(&Target{URL: s.URL, Size: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Release()
+	close(s.release)
+	for i := 0; i < 100 && l.Sum(s.URL) == ""; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	// 读取者在缓冲区分配之前加入,下载完成后被淘汰,stream持有的引用保证其仍可读取
+	l.lock.Lock()
+	l.remove(s.URL)
+	l.lock.Unlock()
+	bs, _, err := st.All(context.Background())
+	if err != nil || string(bs) != "headtail" {
+		t.Fatalf("read %q %v", bs, err)
+	}
+}
+
+func TestStreamSizeMismatch(t *testing.T) {
+	for _, body := range []string{"short", "too long body"} {
+		var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+		var l = NewLockGeter(time.Minute, 1<<20)
+		st, err := l.Stream(&Target{URL: server.URL, Size: 8})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 长度不符要到读取最后一个分片时才能确定
+		if _, err = st.Read(context.Background(), 4, 8); err == nil {
+			t.Fatalf("%s: size mismatch not detected", body)
+		}
+		st.Release()
+		server.Close()
+	}
+}
+
+func TestBufferStream(t *testing.T) {
+	var st = NewBufferStream(NewBuffer([]byte("hello")), "sum")
+	bs, sum, err := st.All(context.Background())
+	if err != nil || string(bs) != "hello" || sum != "sum" {
+		t.Fatalf("all %q %q %v", bs, sum, err)
+	}
+	var o = st.Observe()
+	st.Release()
+	if bs, err = o.Read(context.Background(), 1, 3); err != nil || string(bs) != "el" {
+		t.Fatalf("observer read %q %v", bs, err)
+	}
+	o.Release()
+}
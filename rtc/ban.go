@@ -0,0 +1,223 @@
+package rtc
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"videortc/util"
+)
+
+const (
+	// 分数达到此值则封禁
+	banThreshold = 100
+	banDuration  = time.Hour
+	// 第几次被封禁时改为永久封禁
+	permanentAfter = 3
+	// 分数每过这么久减半
+	scoreHalfLife = time.Minute * 10
+	// 每秒允许的resolve数量和突发数量
+	resolveRate  = 20
+	resolveBurst = 60
+
+	scoreMalformed = 10
+	scoreUnknown   = 5
+	scoreRate      = 2
+	scoreInvalid   = 10
+)
+
+var blocklist = newBanList(os.Getenv("BAN_FILE"))
+
+// BanItem for banned peer, Until为零值表示永久封禁
+type BanItem struct {
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason"`
+	Count  int       `json:"count"`
+}
+
+type abuseScore struct {
+	score     float64
+	time      time.Time
+	tokens    float64
+	tokenTime time.Time
+}
+
+// banList 记录每个Peer的滥用分数,超过阈值则封禁,封禁列表保存到文件
+type banList struct {
+	file   string
+	bans   map[string]*BanItem
+	scores map[string]*abuseScore
+	onBan  func(id string)
+	lock   *sync.Mutex
+}
+
+func newBanList(file string) *banList {
+	var b = &banList{
+		file:   file,
+		bans:   map[string]*BanItem{},
+		scores: map[string]*abuseScore{},
+		lock:   &sync.Mutex{},
+	}
+	if file == "" {
+		return b
+	}
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			util.Log.Print(err)
+		}
+		return b
+	}
+	if err = json.Unmarshal(bs, &b.bans); err != nil {
+		util.Log.Print(err)
+	}
+	return b
+}
+
+func (b *BanItem) active(now time.Time) bool {
+	return b.Until.IsZero() || now.Before(b.Until)
+}
+
+// banned 此Peer当前是否被封禁
+func (b *banList) banned(id string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	item, ok := b.bans[id]
+	return ok && item.active(time.Now())
+}
+
+// report 增加滥用分数,达到阈值时封禁,返回是否已被封禁
+func (b *banList) report(id string, score float64, reason string) bool {
+	var now = time.Now()
+	b.lock.Lock()
+	s := b.getScore(id, now)
+	s.score += score
+	if s.score < banThreshold {
+		b.lock.Unlock()
+		return false
+	}
+	delete(b.scores, id)
+	var d = banDuration
+	if item, ok := b.bans[id]; ok && item.Count+1 >= permanentAfter {
+		d = 0
+	}
+	b.lock.Unlock()
+	b.ban(id, d, reason)
+	return true
+}
+
+// allowResolve resolve限速,超出速率的请求丢弃并计分
+func (b *banList) allowResolve(id string) bool {
+	var now = time.Now()
+	b.lock.Lock()
+	s := b.getScore(id, now)
+	s.tokens = math.Min(resolveBurst, s.tokens+now.Sub(s.tokenTime).Seconds()*resolveRate)
+	s.tokenTime = now
+	if s.tokens >= 1 {
+		s.tokens--
+		b.lock.Unlock()
+		return true
+	}
+	b.lock.Unlock()
+	b.report(id, scoreRate, "resolve rate")
+	return false
+}
+
+// getScore 获取分数并按时间衰减,需持有锁
+func (b *banList) getScore(id string, now time.Time) *abuseScore {
+	s, ok := b.scores[id]
+	if !ok {
+		s = &abuseScore{
+			time:      now,
+			tokens:    resolveBurst,
+			tokenTime: now,
+		}
+		b.scores[id] = s
+		return s
+	}
+	s.score *= math.Pow(0.5, float64(now.Sub(s.time))/float64(scoreHalfLife))
+	s.time = now
+	return s
+}
+
+// ban 封禁此Peer,d为0时永久封禁
+func (b *banList) ban(id string, d time.Duration, reason string) {
+	var now = time.Now()
+	b.lock.Lock()
+	item, ok := b.bans[id]
+	if !ok {
+		item = &BanItem{}
+		b.bans[id] = item
+	}
+	item.Count++
+	item.Reason = reason
+	item.Until = time.Time{}
+	if d > 0 {
+		item.Until = now.Add(d)
+	}
+	util.Log.Printf("Ban peer %s until %s : %s", id, item.Until, reason)
+	b.clean(now)
+	b.lock.Unlock()
+	b.save()
+	if b.onBan != nil {
+		b.onBan(id)
+	}
+}
+
+func (b *banList) unban(id string) {
+	b.lock.Lock()
+	delete(b.bans, id)
+	delete(b.scores, id)
+	b.lock.Unlock()
+	b.save()
+}
+
+// clean 过期超过一天的封禁记录不再保留,需持有锁
+func (b *banList) clean(now time.Time) {
+	for id, item := range b.bans {
+		if !item.Until.IsZero() && now.Sub(item.Until) > time.Hour*24 {
+			delete(b.bans, id)
+		}
+	}
+	for id, s := range b.scores {
+		if now.Sub(s.time) > scoreHalfLife*6 {
+			delete(b.scores, id)
+		}
+	}
+}
+
+func (b *banList) list() map[string]*BanItem {
+	var res = map[string]*BanItem{}
+	b.lock.Lock()
+	for id, item := range b.bans {
+		var v = *item
+		res[id] = &v
+	}
+	b.lock.Unlock()
+	return res
+}
+
+// save 先写临时文件再rename,避免写入中途崩溃损坏文件
+func (b *banList) save() {
+	if b.file == "" {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	bs, err := json.Marshal(b.bans)
+	if err != nil {
+		util.Log.Print(err)
+		return
+	}
+	var tmp = b.file + ".tmp"
+	if err = ioutil.WriteFile(tmp, bs, 0644); err != nil {
+		util.Log.Print(err)
+		return
+	}
+	if err = os.Rename(tmp, b.file); err != nil {
+		util.Log.Print(err)
+	}
+}
@@ -0,0 +1,112 @@
+package rtc
+
+import (
+	"sync"
+	"time"
+
+	"videortc/util"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	candidateTTL = time.Second * 30
+	// 每个ID最多暂存的candidate数,以及最多暂存多少个ID,超出的丢弃
+	maxPendingCandidates = 32
+	maxPendingPeers      = 1024
+)
+
+type pendingCandidate struct {
+	time      time.Time
+	candidate webrtc.ICECandidateInit
+}
+
+// candidateQueue 暂存还不能使用的candidate:对应的Peer还未创建,或者还未设置RemoteDescription
+// 按对方ID分组,设置RemoteDescription后再一并加入,超过candidateTTL的定时丢弃
+type candidateQueue struct {
+	pending map[string][]*pendingCandidate
+	lock    *sync.Mutex
+}
+
+func newCandidateQueue() *candidateQueue {
+	var q = &candidateQueue{
+		pending: map[string][]*pendingCandidate{},
+		lock:    &sync.Mutex{},
+	}
+	go q.loop()
+	return q
+}
+
+// dispatch 对应的Peer已设置RemoteDescription时直接加入,否则暂存
+// 查找Peer和暂存与flush持有同一把锁,暂存的candidate不会在flush之后才加入队列
+func (q *candidateQueue) dispatch(id string, lookup func() *Peer, candidate webrtc.ICECandidateInit) error {
+	q.lock.Lock()
+	var peer = lookup()
+	if peer == nil || peer.conn.RemoteDescription() == nil {
+		q.add(id, candidate)
+		q.lock.Unlock()
+		return nil
+	}
+	q.lock.Unlock()
+	if err := peer.conn.AddICECandidate(candidate); err != nil && !peer.ignoring() {
+		return err
+	}
+	return nil
+}
+
+// add 需持有锁
+func (q *candidateQueue) add(id string, candidate webrtc.ICECandidateInit) {
+	var items, ok = q.pending[id]
+	if (!ok && len(q.pending) >= maxPendingPeers) || len(items) >= maxPendingCandidates {
+		return
+	}
+	q.pending[id] = append(items, &pendingCandidate{
+		time:      time.Now(),
+		candidate: candidate,
+	})
+}
+
+// take 取出此ID所有未过期的candidate, 需持有锁
+func (q *candidateQueue) take(id string) []webrtc.ICECandidateInit {
+	items := q.pending[id]
+	delete(q.pending, id)
+	var res = []webrtc.ICECandidateInit{}
+	for _, item := range items {
+		if time.Since(item.time) < candidateTTL {
+			res = append(res, item.candidate)
+		}
+	}
+	return res
+}
+
+func (q *candidateQueue) loop() {
+	var ticker = time.NewTicker(candidateTTL)
+	defer ticker.Stop()
+	for range ticker.C {
+		q.clean()
+	}
+}
+
+func (q *candidateQueue) clean() {
+	var now = time.Now()
+	q.lock.Lock()
+	for id, items := range q.pending {
+		// 同一ID的candidate按时间顺序加入,最后一个过期则全部过期
+		if now.Sub(items[len(items)-1].time) > candidateTTL {
+			delete(q.pending, id)
+		}
+	}
+	q.lock.Unlock()
+}
+
+// flush 将暂存的candidate加入已设置RemoteDescription的Peer
+func (q *candidateQueue) flush(id string, peer *Peer) {
+	q.lock.Lock()
+	var candidates = q.take(id)
+	q.lock.Unlock()
+	for _, candidate := range candidates {
+		if err := peer.conn.AddICECandidate(candidate); err != nil {
+			util.Log.Print(err)
+		}
+	}
+}
@@ -2,12 +2,25 @@ package rtc
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"sync/atomic"
 	"time"
 	"videortc/util"
 	"videortc/video"
 
 	"github.com/pion/webrtc/v3"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// 批量查询最多的分段数量
+	maxBatch = 4096
+	// 补发分片的最大序号
+	maxChunks = 4096
+	// resolve的deadline最大值,与发送任务的超时一致
+	maxDeadline = time.Minute * 5
 )
 
 var (
@@ -15,8 +28,12 @@ var (
 	dcResolveMsg = make(chan *resolveEvent)
 	dcPingMsg    = make(chan *pingPongEvent)
 	dcQuitMsg    = make(chan *quitEvent)
+	dcBatchMsg   = make(chan *batchEvent)
+	dcSubMsg     = make(chan *subscribeEvent)
 	worker       = make(chan func() error)
 	vHub         = video.NewMediaHub()
+	// 正在停止服务,不再回复found
+	closing int32
 )
 
 type vinfo struct {
@@ -26,17 +43,66 @@ type vinfo struct {
 
 // 对方发来此类型
 type queryEvent struct {
-	dc *webrtc.DataChannel
+	dc   *webrtc.DataChannel
+	from string
+	caps *video.Caps
 	vinfo
 }
 
-// 收到此响应需要队列回复他二进制
-type resolveEvent queryEvent
+// 收到此响应需要队列回复他二进制,chunks不为空时只发送这些分片
+type resolveEvent struct {
+	queryEvent
+	chunks   []int
+	priority int
+	deadline time.Time
+}
 
 type quitEvent queryEvent
 
-// 给对方回复found
+// 给对方回复found,已缓存的分段附带其字节数和sha256
 type foundEvent struct {
+	Event string    `json:"event"`
+	Data  foundInfo `json:"data"`
+}
+
+type foundInfo struct {
+	vinfo
+	Size   int    `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// 批量查询,指定from,to范围或者indexes列表
+type batchEvent struct {
+	dc      *webrtc.DataChannel
+	id      string
+	start   *uint64
+	indexes []uint64
+}
+
+// 回复批量查询,ready和fetch为位图(json中为base64)
+type bitmapEvent struct {
+	Event string     `json:"event"`
+	Data  bitmapInfo `json:"data"`
+}
+
+type bitmapInfo struct {
+	ID      string   `json:"id"`
+	From    *uint64  `json:"from,omitempty"`
+	Count   int      `json:"count"`
+	Indexes []uint64 `json:"indexes,omitempty"`
+	Ready   []byte   `json:"ready"`
+	Fetch   []byte   `json:"fetch"`
+}
+
+// 对方订阅或取消订阅视频流
+type subscribeEvent struct {
+	peer *Peer
+	id   string
+	on   bool
+}
+
+// 通知订阅者此分段已在缓存中
+type haveEvent struct {
 	Event string `json:"event"`
 	Data  vinfo  `json:"data"`
 }
@@ -45,6 +111,7 @@ type foundEvent struct {
 type pingPongEvent struct {
 	dc    *webrtc.DataChannel
 	Event string `json:"event"`
+	data  string // ping携带的data原样返回
 }
 
 func init() {
@@ -57,17 +124,25 @@ func waitMsg() {
 		select {
 		case data := <-dcQueryMsg:
 			fn := func() error {
+				if atomic.LoadInt32(&closing) == 1 {
+					return nil
+				}
 				if !vHub.Ok(data.ID) {
 					return nil
 				}
 				if data.dc.ReadyState() != webrtc.DataChannelStateOpen {
 					return nil
 				}
+				sum, size := vHub.Sum(data.ID, data.Index)
 				var v = &foundEvent{
 					Event: "found",
-					Data: vinfo{
-						Index: data.Index,
-						ID:    data.ID,
+					Data: foundInfo{
+						vinfo: vinfo{
+							Index: data.Index,
+							ID:    data.ID,
+						},
+						Size:   size,
+						SHA256: sum,
 					},
 				}
 				return sendFound(data.dc, v)
@@ -80,7 +155,24 @@ func waitMsg() {
 
 		case data := <-dcResolveMsg:
 			fn := func() error {
-				return vHub.Response(data.dc, data.ID, data.Index)
+				err := vHub.Response(data.dc, &video.Resolve{
+					Peer:     data.from,
+					ID:       data.ID,
+					Index:    data.Index,
+					Caps:     data.caps,
+					Chunks:   data.chunks,
+					Priority: data.priority,
+					Deadline: data.deadline,
+				})
+				if errors.Is(err, video.ErrInvalidID) {
+					blocklist.report(data.from, scoreInvalid, "resolve invalid id")
+					return nil
+				}
+				// 资源不存在或上游暂时不可用不是对方的问题,不计分
+				if errors.Is(err, video.ErrNotFound) || errors.Is(err, video.ErrUnavailable) || errors.Is(err, video.ErrDraining) {
+					return nil
+				}
+				return err
 			}
 			select {
 			case worker <- fn:
@@ -90,7 +182,57 @@ func waitMsg() {
 
 		case data := <-dcPingMsg:
 			fn := func() error {
-				return sendPong(data.dc)
+				return sendPong(data.dc, data.data)
+			}
+			select {
+			case worker <- fn:
+			case <-time.After(time.Second):
+				go runIt(fn)
+			}
+		case data := <-dcBatchMsg:
+			fn := func() error {
+				if atomic.LoadInt32(&closing) == 1 {
+					return nil
+				}
+				ready, fetch, err := vHub.Availability(data.id, data.indexes)
+				if err != nil {
+					return err
+				}
+				var v = &bitmapEvent{
+					Event: "bitmap",
+					Data: bitmapInfo{
+						ID:    data.id,
+						From:  data.start,
+						Count: len(data.indexes),
+						Ready: ready,
+						Fetch: fetch,
+					},
+				}
+				if data.start == nil {
+					v.Data.Indexes = data.indexes
+				}
+				return sendJSON(data.dc, v)
+			}
+			select {
+			case worker <- fn:
+			case <-time.After(time.Second):
+				go runIt(fn)
+			}
+		case data := <-dcSubMsg:
+			fn := func() error {
+				if !data.on {
+					vHub.Unsubscribe(data.peer.id, data.id)
+					return nil
+				}
+				err := vHub.Subscribe(data.peer.id, data.id, data.peer.sendHave)
+				if errors.Is(err, video.ErrInvalidID) {
+					blocklist.report(data.peer.id, scoreInvalid, "subscribe invalid id")
+					return nil
+				}
+				if errors.Is(err, video.ErrNotFound) || errors.Is(err, video.ErrUnavailable) {
+					return nil
+				}
+				return err
 			}
 			select {
 			case worker <- fn:
@@ -99,7 +241,7 @@ func waitMsg() {
 			}
 		case data := <-dcQuitMsg:
 			fn := func() error {
-				return vHub.QuitResponse(data.dc, data.ID, data.Index)
+				return vHub.QuitResponse(data.from, data.dc, data.ID, data.Index)
 			}
 			select {
 			case worker <- fn:
@@ -123,29 +265,147 @@ func runIt(fn func() error) {
 	}
 }
 
-func sendPong(d *webrtc.DataChannel) error {
+func sendPong(d *webrtc.DataChannel, data string) error {
 	if badDc(d.ReadyState()) {
 		return nil
 	}
-	return d.SendText(`{"event":"pong"}`)
+	if data == "" {
+		return d.SendText(`{"event":"pong"}`)
+	}
+	return d.SendText(fmt.Sprintf(`{"event":"pong","data":%s}`, data))
 }
 
-func sendPing(d *webrtc.DataChannel) error {
+// sendPing 携带序号和发送时间(毫秒),对方在pong中原样返回,用于计算RTT
+func sendPing(d *webrtc.DataChannel, seq uint64, t time.Time) error {
 	if d == nil {
 		return io.ErrClosedPipe
 	}
 	if badDc(d.ReadyState()) {
 		return nil
 	}
-	return d.SendText(`{"event":"ping"}`)
+	return d.SendText(fmt.Sprintf(`{"event":"ping","data":{"seq":%d,"ts":%d}}`, seq, t.UnixNano()/int64(time.Millisecond)))
+}
+
+// parseDeadline deadline为距现在的毫秒数,不传或超出范围时没有截止时间
+func parseDeadline(g gjson.Result) time.Time {
+	var ms = g.Int()
+	if ms <= 0 || time.Duration(ms)*time.Millisecond > maxDeadline {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(ms) * time.Millisecond)
+}
+
+// parseChunks 解析需要补发的分片,形如 [1,[4,8],12] ,数组表示闭区间
+func parseChunks(g gjson.Result) ([]int, bool) {
+	var chunks = []int{}
+	for _, v := range g.Array() {
+		if v.IsArray() {
+			var (
+				start = v.Get("0").Int()
+				end   = v.Get("1").Int()
+			)
+			if start < 0 || end < start || end >= maxChunks {
+				return nil, false
+			}
+			for i := start; i <= end; i++ {
+				chunks = append(chunks, int(i))
+			}
+		} else {
+			var i = v.Int()
+			if i < 0 || i >= maxChunks {
+				return nil, false
+			}
+			chunks = append(chunks, int(i))
+		}
+		if len(chunks) > maxChunks {
+			return nil, false
+		}
+	}
+	return chunks, true
+}
+
+// parseBatch 解析批量查询,没有indexes或from/to、数量超过maxBatch或范围不合法返回nil
+func parseBatch(d *webrtc.DataChannel, g gjson.Result) *batchEvent {
+	var ev = &batchEvent{
+		dc: d,
+		id: g.Get("data.id").String(),
+	}
+	if indexes := g.Get("data.indexes"); indexes.IsArray() {
+		// 逐个读取,超过maxBatch即停止,不为对方发送的超长数组分配内存
+		var tooMany bool
+		indexes.ForEach(func(_, v gjson.Result) bool {
+			if len(ev.indexes) >= maxBatch {
+				tooMany = true
+				return false
+			}
+			ev.indexes = append(ev.indexes, v.Uint())
+			return true
+		})
+		if tooMany {
+			return nil
+		}
+	} else {
+		var from, to = g.Get("data.from"), g.Get("data.to")
+		if !from.Exists() || !to.Exists() {
+			// 既没有列表也没有范围
+			return nil
+		}
+		var (
+			start = from.Uint()
+			end   = to.Uint()
+		)
+		if end < start || end-start >= maxBatch {
+			return nil
+		}
+		ev.start = &start
+		for i := start; i <= end; i++ {
+			ev.indexes = append(ev.indexes, i)
+		}
+	}
+	if ev.id == "" || len(ev.indexes) == 0 || len(ev.indexes) > maxBatch {
+		return nil
+	}
+	return ev
+}
+
+// helloEvent DataChannel打开时发送,告知对方我们的协议版本和支持的能力
+type helloEvent struct {
+	Event string      `json:"event"`
+	Data  *video.Caps `json:"data"`
+}
+
+func sendHello(d *webrtc.DataChannel) error {
+	bs, err := json.Marshal(&helloEvent{
+		Event: "hello",
+		Data:  video.LocalCaps(),
+	})
+	if err != nil {
+		return err
+	}
+	if badDc(d.ReadyState()) {
+		return nil
+	}
+	return d.SendText(string(bs))
+}
+
+// sendBye 告知对方我们即将离开
+func sendBye(d *webrtc.DataChannel) error {
+	if d == nil || d.ReadyState() != webrtc.DataChannelStateOpen {
+		return nil
+	}
+	return d.SendText(`{"event":"bye"}`)
 }
 
 func sendFound(d *webrtc.DataChannel, v *foundEvent) error {
+	return sendJSON(d, v)
+}
+
+func sendJSON(d *webrtc.DataChannel, v interface{}) error {
 	bs, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
-	if badDc(d.ReadyState()) {
+	if d == nil || badDc(d.ReadyState()) {
 		return nil
 	}
 	return d.SendText(string(bs))
@@ -0,0 +1,160 @@
+package rtc
+
+import (
+	"sync"
+	"time"
+
+	"videortc/util"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	pingInterval = time.Second * 10
+	// 连续这么多次ping没有收到pong则认为此Peer已不可用
+	maxMissed = 3
+)
+
+// health 记录ping/pong结果,计算RTT和丢失率
+type health struct {
+	seq      uint64
+	tick     uint64 // check的次数,发送ping时记录当前值
+	pending  map[uint64]*pendingPing
+	rtt      time.Duration
+	srtt     time.Duration
+	lastSeen time.Time
+	sent     uint64
+	lost     uint64
+	missed   int
+	lock     *sync.Mutex
+}
+
+// PeerHealth for peer ping stats
+type PeerHealth struct {
+	RTT      int64 // 最近一次RTT,毫秒
+	SRTT     int64 // 平滑RTT,毫秒
+	LastSeen time.Time
+	Sent     uint64
+	Lost     uint64
+	Loss     float64
+	Missed   int
+}
+
+type pendingPing struct {
+	time time.Time
+	tick uint64
+}
+
+func newHealth() *health {
+	return &health{
+		pending: map[uint64]*pendingPing{},
+		lock:    &sync.Mutex{},
+	}
+}
+
+// next 生成一个新的ping序号
+func (h *health) next() (uint64, time.Time) {
+	var now = time.Now()
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.seq++
+	h.sent++
+	h.pending[h.seq] = &pendingPing{time: now, tick: h.tick}
+	return h.seq, now
+}
+
+// pong 匹配对应的ping计算RTT,对方的pong不带序号时(旧版客户端)匹配最早的一个
+func (h *health) pong(g gjson.Result) {
+	var now = time.Now()
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var seq = g.Get("data.seq").Uint()
+	if _, ok := h.pending[seq]; !ok {
+		seq = 0
+		for k := range h.pending {
+			if seq == 0 || k < seq {
+				seq = k
+			}
+		}
+	}
+	h.lastSeen = now
+	h.missed = 0
+	sent, ok := h.pending[seq]
+	if !ok {
+		return
+	}
+	delete(h.pending, seq)
+	h.rtt = now.Sub(sent.time)
+	if h.srtt == 0 {
+		h.srtt = h.rtt
+	} else {
+		h.srtt = (h.srtt*7 + h.rtt) / 8
+	}
+}
+
+// check 每个周期调用一次,上个周期及之前发送且未回复的ping记为丢失,返回此Peer是否仍然健康
+// 周期之间额外发送的ping至少等待半个周期
+func (h *health) check(now time.Time) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.tick++
+	for seq, sent := range h.pending {
+		if sent.tick < h.tick && now.Sub(sent.time) >= pingInterval/2 {
+			delete(h.pending, seq)
+			h.lost++
+			h.missed++
+		}
+	}
+	return h.missed < maxMissed
+}
+
+func (h *health) stats() *PeerHealth {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var loss float64
+	if h.sent > 0 {
+		loss = float64(h.lost) / float64(h.sent)
+	}
+	return &PeerHealth{
+		RTT:      h.rtt.Milliseconds(),
+		SRTT:     h.srtt.Milliseconds(),
+		LastSeen: h.lastSeen,
+		Sent:     h.sent,
+		Lost:     h.lost,
+		Loss:     loss,
+		Missed:   h.missed,
+	}
+}
+
+// supervise 定期ping所有Peer,清理不健康的Peer;持锁时只挑选,关闭和发送在释放锁之后进行
+// 对方发送hello之前仍然ping并统计丢失,但不因此断开
+func (m *PeerManager) supervise() {
+	var ticker = time.NewTicker(pingInterval)
+	for now := range ticker.C {
+		m.cleanPeers()
+		var dead, alive []*Peer
+		m.lock.Lock()
+		for id, p := range m.peers {
+			if d := p.control(); d == nil || d.ReadyState() != webrtc.DataChannelStateOpen {
+				continue
+			}
+			if !p.health.check(now) && p.negotiated() {
+				dead = append(dead, p)
+				delete(m.peers, id)
+				continue
+			}
+			alive = append(alive, p)
+		}
+		m.lock.Unlock()
+		for _, p := range dead {
+			util.Log.Printf("Peer %s missed %d pongs, close it", p.id, maxMissed)
+			p.Close()
+		}
+		for _, p := range alive {
+			if err := p.Ping(); err != nil {
+				util.Log.Print(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package rtc
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const defaultTurnTTL = time.Hour * 24
+
+// iceProvider 生成PeerConnection使用的ICE Server配置
+// 配置了TURN_SECRET时使用TURN REST API方式,由共享密钥派生有时效的用户名和密码,过期前会自动刷新
+type iceProvider struct {
+	stuns      []string
+	turns      []string
+	username   string
+	credential string
+	defaults   bool     // username/credential是默认ICE Server的公开凭证,不能用于内置TURN服务
+	locals     []string // 内置TURN服务的地址
+	turnUser   string   // 内置TURN服务的静态凭证,未配置TURN_SECRET时使用
+	turnCred   string
+	secret     string
+	ttl        time.Duration
+	expire     time.Time
+	servers    []webrtc.ICEServer
+	lock       *sync.Mutex
+}
+
+func newIceProvider() *iceProvider {
+	var p = &iceProvider{
+		username:   os.Getenv("ICE_USERNAME"),
+		credential: os.Getenv("ICE_CREDENTIAL"),
+		secret:     os.Getenv("TURN_SECRET"),
+		ttl:        defaultTurnTTL,
+		lock:       &sync.Mutex{},
+	}
+	if s := os.Getenv("TURN_TTL"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 60 {
+			panic(fmt.Errorf("error TURN_TTL %s", s))
+		}
+		p.ttl = time.Second * time.Duration(n)
+	}
+	var servers = os.Getenv("ICE_SERVERS")
+	if servers == "" {
+		// 未配置时使用默认的ICE Server
+		servers = "stun:119.29.1.39:3478;turn:119.29.1.39:3478"
+		if p.username == "" && p.secret == "" {
+			p.username = "su"
+			p.credential = "su"
+			p.defaults = true
+		}
+	}
+	for _, str := range strings.Split(servers, ";") {
+		if str = strings.TrimSpace(str); str != "" {
+			p.add(str)
+		}
+	}
+	return p
+}
+
+// addLocal 加入内置TURN服务的地址,与外部TURN服务的凭证分开
+func (p *iceProvider) addLocal(url string) {
+	p.locals = append(p.locals, url)
+	p.expire = time.Time{}
+}
+
+func (p *iceProvider) add(url string) {
+	if strings.HasPrefix(url, "turn:") || strings.HasPrefix(url, "turns:") {
+		p.turns = append(p.turns, url)
+	} else {
+		p.stuns = append(p.stuns, url)
+	}
+	p.expire = time.Time{}
+}
+
+// config 获取当前可用的配置,REST凭证剩余有效期不足一半时重新生成,保证新建的连接拿到的凭证不会很快过期
+func (p *iceProvider) config(id string) webrtc.Configuration {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var now = time.Now()
+	if p.servers == nil || (p.secret != "" && p.expire.Sub(now) < p.ttl/2) {
+		p.servers = p.build(id, now)
+	}
+	return webrtc.Configuration{
+		ICEServers: p.servers,
+	}
+}
+
+func (p *iceProvider) build(id string, now time.Time) []webrtc.ICEServer {
+	var servers = []webrtc.ICEServer{}
+	if len(p.stuns) > 0 {
+		servers = append(servers, webrtc.ICEServer{
+			URLs: p.stuns,
+		})
+	}
+	var username, credential string
+	if p.secret != "" {
+		p.expire = now.Add(p.ttl)
+		username, credential = turnCredentials(p.secret, p.expire, id)
+	}
+	if len(p.turns) > 0 {
+		var server = webrtc.ICEServer{
+			URLs:       p.turns,
+			Username:   p.username,
+			Credential: p.credential,
+		}
+		if p.secret != "" {
+			server.Username, server.Credential = username, credential
+		}
+		servers = append(servers, server)
+	}
+	if len(p.locals) > 0 {
+		var server = webrtc.ICEServer{
+			URLs:       p.locals,
+			Username:   p.turnUser,
+			Credential: p.turnCred,
+		}
+		if p.secret != "" {
+			server.Username, server.Credential = username, credential
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// turnCredentials 按TURN REST API生成凭证,用户名为 过期时间戳:id ,密码为 base64(hmac-sha1(secret,用户名))
+func turnCredentials(secret string, expire time.Time, id string) (string, string) {
+	var username = strconv.FormatInt(expire.Unix(), 10)
+	if id != "" {
+		username = username + ":" + id
+	}
+	return username, hmacSum(secret, username)
+}
+
+func hmacSum(secret string, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
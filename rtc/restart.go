@@ -0,0 +1,108 @@
+package rtc
+
+import (
+	"time"
+
+	"videortc/util"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// 断开后在此时间内尝试ICE restart,超过仍未恢复则由isPeerOk判定为不可用并销毁
+	restartGrace = time.Second * 30
+	// Disconnected经常能自行恢复,稍等再发起restart;Failed则立即发起
+	restartDelay = time.Second * 3
+	// restart后仍未恢复则重试,间隔从此值开始翻倍,直到超过restartGrace
+	restartBackoff = time.Second * 2
+)
+
+// onICEStateChange 记录断开的时间,并在短暂断开时发起ICE restart,而不是直接销毁整个Peer
+func (p *Peer) onICEStateChange(state webrtc.ICEConnectionState) {
+	switch state {
+	case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+		p.lock.Lock()
+		p.disconnected = time.Time{}
+		p.lock.Unlock()
+	case webrtc.ICEConnectionStateDisconnected:
+		p.markDisconnected()
+		time.AfterFunc(restartDelay, p.restart)
+	case webrtc.ICEConnectionStateFailed:
+		p.markDisconnected()
+		go p.restart()
+	}
+}
+
+func (p *Peer) markDisconnected() {
+	p.lock.Lock()
+	if p.disconnected.IsZero() {
+		p.disconnected = time.Now()
+	}
+	p.lock.Unlock()
+}
+
+// recovering 是否仍在断开后的宽限期内
+func (p *Peer) recovering() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.disconnected.IsZero() {
+		// 状态已变化但回调还未执行,从现在开始计算
+		p.disconnected = time.Now()
+	}
+	return time.Since(p.disconnected) < restartGrace
+}
+
+// restart 通过ws信令发送带ICERestart的offer,未恢复时退避重试直到宽限期结束,同一时间只进行一次
+func (p *Peer) restart() {
+	if p.conn.RemoteDescription() == nil || !p.needRestart() {
+		return
+	}
+	p.lock.Lock()
+	if p.restarting {
+		p.lock.Unlock()
+		return
+	}
+	p.restarting = true
+	p.lock.Unlock()
+	defer func() {
+		p.lock.Lock()
+		p.restarting = false
+		p.lock.Unlock()
+	}()
+	for backoff := restartBackoff; p.needRestart(); backoff *= 2 {
+		if p.conn.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+			// 上次的offer对方没有回复,撤回后重新发起
+			if err := p.rollback(); err != nil {
+				util.Log.Print(err)
+			}
+		}
+		if p.conn.SignalingState() == webrtc.SignalingStateStable {
+			util.Log.Printf("ICE restart %s", p.id)
+			if err := p.restartOffer(); err != nil {
+				util.Log.Print(err)
+			}
+		}
+		time.Sleep(backoff)
+	}
+}
+
+// restartOffer 原有的REST凭证可能已过期,先更新ICE Server配置再发起带ICERestart的offer
+func (p *Peer) restartOffer() error {
+	var config = p.conn.GetConfiguration()
+	config.ICEServers = p.ice.config(p.ws.ID).ICEServers
+	if err := p.conn.SetConfiguration(config); err != nil {
+		return err
+	}
+	return p.negotiate(&webrtc.OfferOptions{ICERestart: true})
+}
+
+// needRestart ICE仍处于断开状态且未超过宽限期
+func (p *Peer) needRestart() bool {
+	var state = p.conn.ICEConnectionState()
+	if state != webrtc.ICEConnectionStateDisconnected && state != webrtc.ICEConnectionStateFailed {
+		return false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return !p.disconnected.IsZero() && time.Since(p.disconnected) < restartGrace
+}
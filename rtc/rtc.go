@@ -1,52 +1,72 @@
 package rtc
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"videortc/util"
 	"videortc/video"
 	"videortc/ws"
 
+	"github.com/pion/turn/v2"
 	"github.com/pion/webrtc/v3"
 	"github.com/tidwall/gjson"
 )
 
+const peerIdle = time.Second * 30
+
 var (
-	config = webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:119.29.1.39:3478"},
-			},
-			{
-				URLs:       []string{"turn:119.29.1.39:3478"},
-				Username:   "su",
-				Credential: "su",
-			},
-		},
-	}
 	maxPacketLifeTime = uint16(2000)
+	ctrlLabel         = "ctrl"
+	// ErrPeerFull 连接数已达上限,且没有可淘汰的Peer
+	ErrPeerFull = errors.New("peer full")
+	// ErrPeerBanned 此Peer已被封禁
+	ErrPeerBanned = errors.New("peer banned")
+	// ErrClosing 正在停止服务
+	ErrClosing = errors.New("closing")
 )
 
 // Peer mean rtc peer
 type Peer struct {
-	time time.Time
-	ws   *ws.Peer
-	conn *webrtc.PeerConnection
-	dc   *webrtc.DataChannel
+	id           string
+	time         time.Time
+	ws           *ws.Peer
+	ice          *iceProvider
+	conn         *webrtc.PeerConnection
+	dc           *webrtc.DataChannel // 部分可靠的通道,用于媒体数据
+	ctrl         *webrtc.DataChannel // 可靠有序的通道,用于控制消息,旧版客户端没有此通道
+	active       int64               // 最近一次收到DataChannel消息的时间(UnixNano)
+	served       uint64              // 对方resolve的次数,用于衡量此连接的价值
+	polite       bool                // 双方同时发起offer时,polite一方让步,按ID大小决定
+	makingOffer  bool
+	ignoreOffer  bool
+	restarting   bool
+	disconnected time.Time   // ICE断开的时间,恢复后清零
+	caps         *video.Caps // 通过hello协商后的能力,对方没有发送hello时为nil
+	health       *health
+	lock         *sync.Mutex
 }
 
 // PeerManager manage every user peer
 type PeerManager struct {
-	ws    *ws.Peer
-	api   *webrtc.API
-	peers map[string]*Peer
-	lock  *sync.RWMutex
+	ws         *ws.Peer
+	api        *webrtc.API
+	ice        *iceProvider
+	turn       *turn.Server
+	max        int
+	reserved   int // 已通过admit正在创建的Peer数,与peers一起受MAX_PEERS限制
+	peers      map[string]*Peer
+	candidates *candidateQueue
+	lock       *sync.RWMutex
 }
 
 // DataChannelStatus for datachannel
@@ -60,10 +80,15 @@ type DataChannelStatus struct {
 // ConnState for conn status
 type ConnState struct {
 	Time               time.Time
+	Active             time.Time
+	Served             uint64
+	Caps               *video.Caps
 	ConnectionState    string
 	ICEConnectionState string
 	ICEGatheringState  string
+	Health             *PeerHealth
 	DataChannelStatus  *DataChannelStatus
+	ControlStatus      *DataChannelStatus
 	PeerStatus         webrtc.StatsReport
 }
 
@@ -108,11 +133,29 @@ func getApi() *webrtc.API {
 
 // NewPeerManager do peer manage
 func NewPeerManager() *PeerManager {
-	return &PeerManager{
-		api:   getApi(),
-		peers: map[string]*Peer{},
-		lock:  &sync.RWMutex{},
+	var ice = newIceProvider()
+	server, err := startTurn(ice)
+	if err != nil {
+		panic(err)
+	}
+	var max int
+	if s := os.Getenv("MAX_PEERS"); s != "" {
+		if max, err = strconv.Atoi(s); err != nil {
+			panic(err)
+		}
 	}
+	var m = &PeerManager{
+		api:        getApi(),
+		ice:        ice,
+		turn:       server,
+		max:        max,
+		peers:      map[string]*Peer{},
+		candidates: newCandidateQueue(),
+		lock:       &sync.RWMutex{},
+	}
+	blocklist.onBan = m.kick
+	go m.supervise()
+	return m
 }
 
 // SetSignal 设置信令服务器
@@ -127,6 +170,12 @@ func (m *PeerManager) Ensure(id string) (*Peer, bool, error) {
 		ok   bool
 		err  error
 	)
+	if blocklist.banned(id) {
+		return nil, false, ErrPeerBanned
+	}
+	if atomic.LoadInt32(&closing) == 1 {
+		return nil, false, ErrClosing
+	}
 	m.cleanPeers()
 	m.lock.RLock()
 	peer, ok = m.peers[id]
@@ -136,47 +185,128 @@ func (m *PeerManager) Ensure(id string) (*Peer, bool, error) {
 			return peer, false, nil
 		}
 		peer.Close()
+	} else if !m.admit() {
+		m.refuse(id)
+		return nil, true, ErrPeerFull
 	}
-	peer, err = m.newPeer()
+	// 检查数量和加入peers之间不持有锁,通过reserved占位,并发的offer不会超过上限
+	var reserved = !ok && m.max > 0
+	peer, err = m.newPeer(id)
+	m.lock.Lock()
+	if reserved {
+		m.reserved--
+	}
+	if err == nil {
+		m.peers[id] = peer
+	}
+	m.lock.Unlock()
 	if err != nil {
 		return nil, true, err
 	}
+	return peer, true, nil
+}
+
+// admit 检查是否还能新建Peer并占位,已满时尝试淘汰一个空闲的Peer:resolve最少的优先,其次是最久未活跃的
+func (m *PeerManager) admit() bool {
+	if m.max <= 0 {
+		return true
+	}
+	var (
+		now    = time.Now()
+		victim string
+		vpeer  *Peer
+	)
 	m.lock.Lock()
-	m.peers[id] = peer
+	if len(m.peers)+m.reserved >= m.max {
+		for id, p := range m.peers {
+			if now.Sub(p.lastActive()) < peerIdle {
+				continue
+			}
+			if vpeer == nil || evictBefore(p, vpeer) {
+				victim = id
+				vpeer = p
+			}
+		}
+		if vpeer == nil {
+			m.lock.Unlock()
+			return false
+		}
+		delete(m.peers, victim)
+	}
+	m.reserved++
 	m.lock.Unlock()
-	return peer, true, nil
+	if vpeer != nil {
+		util.Log.Printf("Evict peer %s, served %d, last active %s", victim, atomic.LoadUint64(&vpeer.served), vpeer.lastActive())
+		vpeer.Close()
+	}
+	return true
+}
+
+// evictBefore a是否比b更应被淘汰
+func evictBefore(a *Peer, b *Peer) bool {
+	var sa, sb = atomic.LoadUint64(&a.served), atomic.LoadUint64(&b.served)
+	if sa != sb {
+		return sa < sb
+	}
+	return a.lastActive().Before(b.lastActive())
+}
+
+// refuse 通过信令告知对方我们已满,不会接受其连接
+func (m *PeerManager) refuse(id string) {
+	var data = map[string]interface{}{
+		"event": "full",
+		"from":  m.ws.ID,
+		"to":    id,
+	}
+	m.ws.Send(data)
 }
 
 // newPeer create Peer based on the api we created
-func (m *PeerManager) newPeer() (*Peer, error) {
-	peerConnection, err := m.api.NewPeerConnection(config)
+func (m *PeerManager) newPeer(id string) (*Peer, error) {
+	peerConnection, err := m.api.NewPeerConnection(m.ice.config(m.ws.ID))
 	if err != nil {
 		return nil, err
 	}
+	var now = time.Now()
 	var peer = &Peer{
-		time.Now(),
-		m.ws,
-		peerConnection,
-		nil,
+		id:     id,
+		time:   now,
+		ws:     m.ws,
+		ice:    m.ice,
+		conn:   peerConnection,
+		active: now.UnixNano(),
+		polite: m.ws.ID < id,
+		health: newHealth(),
+		lock:   &sync.Mutex{},
 	}
+	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+		var data = map[string]interface{}{
+			"event": "candidate",
+			"from":  peer.ws.ID,
+			"to":    id,
+			"data":  candidate.ToJSON(),
+		}
+		peer.ws.Send(data)
+	})
 	// Set the handler for ICE connection state
 	// This will notify you when the peer has connected/disconnected
 	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
 		util.Log.Printf("ICE Connection State has changed: %s\n", connectionState.String())
+		peer.onICEStateChange(connectionState)
 	})
 	// Register data channel creation handling
 	peerConnection.OnDataChannel(func(d *webrtc.DataChannel) {
-		if peer.dc != nil {
-			peer.dc.Close()
-		}
-		initDc(d)
-		peer.dc = d
+		peer.initDc(d)
+		peer.setChannel(d)
 	})
 
 	return peer, nil
 }
 
-//get 创建新的Peer实例,如果有旧的则清理它
+// get 创建新的Peer实例,如果有旧的则清理它
 func (m *PeerManager) getPeer(id string) *Peer {
 	var (
 		peer *Peer
@@ -189,6 +319,12 @@ func (m *PeerManager) getPeer(id string) *Peer {
 
 // Dispatch message to peer ,此函数不能阻塞太久, Accept 可能耗时5s
 func (m *PeerManager) Dispatch(msg *ws.MsgEvent) error {
+	if blocklist.banned(msg.From) {
+		if msg.Event == "offer" {
+			return fmt.Errorf("reject offer from banned peer %s", msg.From)
+		}
+		return nil
+	}
 	if msg.Event == "offer" {
 		// someone send me offer , we should accept that
 		peer, _, err := m.Ensure(msg.From)
@@ -196,12 +332,16 @@ func (m *PeerManager) Dispatch(msg *ws.MsgEvent) error {
 			return err
 		}
 		var sdp = msg.Data.Get("sdp").String()
-		return peer.Accept(webrtc.SDPTypeOffer, sdp, msg)
-	} else if msg.Event == "candidate" {
-		peer := m.getPeer(msg.From)
-		if peer == nil {
-			return fmt.Errorf("not found peer %s", msg.From)
+		if err = peer.Accept(webrtc.SDPTypeOffer, sdp, msg); err != nil {
+			return err
 		}
+		if peer.ignoring() {
+			// 忽略的offer没有设置RemoteDescription,其candidate不能加入
+			return nil
+		}
+		m.candidates.flush(msg.From, peer)
+		return nil
+	} else if msg.Event == "candidate" {
 		var (
 			sdpMid        = msg.Data.Get("sdpMid").String()
 			sdpMLineIndex = uint16(msg.Data.Get("sdpMLineIndex").Uint())
@@ -211,23 +351,83 @@ func (m *PeerManager) Dispatch(msg *ws.MsgEvent) error {
 			SDPMid:        &sdpMid,
 			SDPMLineIndex: &sdpMLineIndex,
 		}
-		return peer.conn.AddICECandidate(candidate)
+		// candidate可能先于offer到达,或者RemoteDescription尚未设置,暂存起来等设置后再加入
+		return m.candidates.dispatch(msg.From, func() *Peer {
+			return m.getPeer(msg.From)
+		}, candidate)
 	} else if msg.Event == "answer" {
 		peer := m.getPeer(msg.From)
 		if peer == nil {
 			return fmt.Errorf("peer not found %s", msg.From)
 		}
-		var desc = webrtc.SessionDescription{
-			Type: webrtc.SDPTypeAnswer,
-			SDP:  msg.Data.Get("sdp").String(),
+		if err := peer.Answer(msg.Data.Get("sdp").String()); err != nil {
+			return err
 		}
-		return peer.conn.SetRemoteDescription(desc)
+		m.candidates.flush(msg.From, peer)
+		return nil
 	} else {
 		util.Log.Print(msg)
 	}
 	return nil
 }
 
+// kick 移除并关闭此Peer,可能在此Peer的DataChannel回调中被调用,关闭需在锁外异步进行
+func (m *PeerManager) kick(id string) {
+	m.lock.Lock()
+	p, ok := m.peers[id]
+	delete(m.peers, id)
+	m.lock.Unlock()
+	if ok {
+		go p.Close()
+	}
+}
+
+// Bans list banned peers
+func (m *PeerManager) Bans() map[string]*BanItem {
+	return blocklist.list()
+}
+
+// Ban 封禁此Peer并断开连接,d为0时永久封禁
+func (m *PeerManager) Ban(id string, d time.Duration, reason string) {
+	blocklist.ban(id, d, reason)
+}
+
+// Unban 解除封禁
+func (m *PeerManager) Unban(id string) {
+	blocklist.unban(id)
+}
+
+// Shutdown 停止回复found,等待队列中的任务在ctx截止前发送完毕,通知所有Peer我们要离开,然后关闭所有连接和ws
+func (m *PeerManager) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&closing, 1)
+	err := vHub.Drain(ctx)
+	m.lock.Lock()
+	var peers = m.peers
+	m.peers = map[string]*Peer{}
+	m.lock.Unlock()
+	for _, p := range peers {
+		if e := sendBye(p.control()); e != nil {
+			util.Log.Print(e)
+		}
+	}
+	// 留一点时间让bye发送出去
+	time.Sleep(time.Millisecond * 200)
+	for _, p := range peers {
+		p.Close()
+	}
+	if m.turn != nil {
+		if e := m.turn.Close(); e != nil {
+			util.Log.Print(e)
+		}
+	}
+	if m.ws != nil {
+		if e := m.ws.Close(); e != nil {
+			util.Log.Print(e)
+		}
+	}
+	return err
+}
+
 // cleanPeers delete closed peers
 func (m *PeerManager) cleanPeers() {
 	m.lock.Lock()
@@ -240,26 +440,35 @@ func (m *PeerManager) cleanPeers() {
 	m.lock.Unlock()
 }
 
+func dcStatus(d *webrtc.DataChannel) *DataChannelStatus {
+	if d == nil {
+		return nil
+	}
+	return &DataChannelStatus{
+		ID:       fmt.Sprintf("%d", d.ID()),
+		Label:    d.Label(),
+		State:    d.ReadyState().String(),
+		Buffered: d.BufferedAmount(),
+	}
+}
+
 // Stats get status info
 func (m *PeerManager) Stats() *PeerManagerStats {
 	var peers = map[string]*ConnState{}
 	m.lock.RLock()
 	for id, peer := range m.peers {
-		var dstatus *DataChannelStatus
-		if peer.dc != nil {
-			dstatus = &DataChannelStatus{
-				ID:       fmt.Sprintf("%d", peer.dc.ID()),
-				Label:    peer.dc.Label(),
-				State:    peer.dc.ReadyState().String(),
-				Buffered: peer.dc.BufferedAmount(),
-			}
-		}
+		var ctrl, dc = peer.channels()
 		peers[id] = &ConnState{
 			Time:               peer.time,
+			Active:             peer.lastActive(),
+			Served:             atomic.LoadUint64(&peer.served),
+			Caps:               peer.getCaps(),
 			ConnectionState:    peer.conn.ConnectionState().String(),
 			ICEConnectionState: peer.conn.ICEConnectionState().String(),
 			ICEGatheringState:  peer.conn.ICEGatheringState().String(),
-			DataChannelStatus:  dstatus,
+			Health:             peer.health.stats(),
+			DataChannelStatus:  dcStatus(dc),
+			ControlStatus:      dcStatus(ctrl),
 			PeerStatus:         peer.conn.GetStats(),
 		}
 	}
@@ -276,25 +485,30 @@ func (m *PeerManager) StatsVideo() *video.VStatus {
 }
 
 // Accept for some peer send me offer to connect me
+// 按perfect negotiation处理双方同时发起offer的情况:impolite一方忽略冲突的offer,polite一方回滚自己的offer后接受对方的
 func (p *Peer) Accept(sdpType webrtc.SDPType, sdp string, msg *ws.MsgEvent) error {
-	p.conn.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-		if candidate == nil {
-			return
-		}
-		var data = map[string]interface{}{
-			"event": "candidate",
-			"from":  p.ws.ID,
-			"to":    msg.From,
-			"data":  candidate.ToJSON(),
-		}
-		p.ws.Send(data)
-	})
-
 	offer := webrtc.SessionDescription{
 		Type: sdpType,
 		SDP:  sdp,
 	}
 
+	p.lock.Lock()
+	var (
+		collision = p.makingOffer || p.conn.SignalingState() != webrtc.SignalingStateStable
+		ignore    = !p.polite && collision
+	)
+	p.ignoreOffer = ignore
+	p.lock.Unlock()
+	if ignore {
+		util.Log.Printf("Ignore colliding offer from %s", msg.From)
+		return nil
+	}
+	if collision {
+		if err := p.rollback(); err != nil {
+			return err
+		}
+	}
+
 	// Set the remote SessionDescription
 	err := p.conn.SetRemoteDescription(offer)
 	if err != nil {
@@ -324,62 +538,164 @@ func (p *Peer) Accept(sdpType webrtc.SDPType, sdp string, msg *ws.MsgEvent) erro
 	return nil
 }
 
-// Connect 主动链接别人, 必须确保这个Peer 处于 new 状态
-func (p *Peer) Connect(id string) error {
-	var fn = func() error {
-		offer, err := p.conn.CreateOffer(nil)
-		if err != nil {
-			return err
-		}
-		var data = map[string]interface{}{
-			"event": "offer",
-			"from":  p.ws.ID,
-			"to":    id,
-			"data":  offer,
-		}
-		p.ws.Send(data)
-		p.conn.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-			if candidate == nil {
-				return
-			}
-			var data = map[string]interface{}{
-				"event": "candidate",
-				"from":  p.ws.ID,
-				"to":    id,
-				"data":  candidate.ToJSON(),
-			}
-			p.ws.Send(data)
-		})
-		err = p.conn.SetLocalDescription(offer)
-		if err != nil {
-			return err
-		}
+// Answer 对方回复了我们的offer,不是在等待answer的状态(例如我们的offer已回滚)则忽略
+func (p *Peer) Answer(sdp string) error {
+	if p.conn.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+		util.Log.Printf("Ignore answer from %s in state %s", p.id, p.conn.SignalingState())
 		return nil
 	}
+	var desc = webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  sdp,
+	}
+	return p.conn.SetRemoteDescription(desc)
+}
+
+// rollback 撤销我们尚未得到回复的offer
+func (p *Peer) rollback() error {
+	var local = p.conn.PendingLocalDescription()
+	if local == nil {
+		return nil
+	}
+	return p.conn.SetLocalDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeRollback,
+		SDP:  local.SDP,
+	})
+}
+
+// negotiate 创建offer并通过ws发送给对方
+func (p *Peer) negotiate(options *webrtc.OfferOptions) error {
+	p.lock.Lock()
+	p.makingOffer = true
+	p.lock.Unlock()
+	defer func() {
+		p.lock.Lock()
+		p.makingOffer = false
+		p.lock.Unlock()
+	}()
+	offer, err := p.conn.CreateOffer(options)
+	if err != nil {
+		return err
+	}
+	if err = p.conn.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	var data = map[string]interface{}{
+		"event": "offer",
+		"from":  p.ws.ID,
+		"to":    p.id,
+		"data":  p.conn.LocalDescription(),
+	}
+	p.ws.Send(data)
+	return nil
+}
+
+// Connect 主动链接别人, 必须确保这个Peer 处于 new 状态
+func (p *Peer) Connect(id string) error {
 	p.conn.OnNegotiationNeeded(func() {
-		if err := fn(); err != nil {
+		if err := p.negotiate(nil); err != nil {
 			util.Log.Print(err)
 		}
 	})
 
-	dc, err := p.conn.CreateDataChannel("dc", &webrtc.DataChannelInit{MaxPacketLifeTime: &maxPacketLifeTime})
+	// 控制消息使用可靠有序的通道,媒体数据使用部分可靠的通道,丢失的分片可再次resolve
+	ctrl, err := p.conn.CreateDataChannel(ctrlLabel, nil)
 	if err != nil {
 		return err
 	}
-	if p.dc != nil {
-		p.dc.Close()
+	p.initDc(ctrl)
+	p.setChannel(ctrl)
+	dc, err := p.conn.CreateDataChannel("dc", &webrtc.DataChannelInit{MaxPacketLifeTime: &maxPacketLifeTime})
+	if err != nil {
+		return err
 	}
-	initDc(dc)
-	p.dc = dc
+	p.initDc(dc)
+	p.setChannel(dc)
 	return nil
 }
 
+// setChannel 按label区分控制通道和数据通道,替换掉旧的
+func (p *Peer) setChannel(d *webrtc.DataChannel) {
+	p.lock.Lock()
+	var old *webrtc.DataChannel
+	if d.Label() == ctrlLabel {
+		old, p.ctrl = p.ctrl, d
+	} else {
+		old, p.dc = p.dc, d
+	}
+	p.lock.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+// control 控制消息使用的通道,对方发送过hello且ctrl已打开时使用ctrl,否则(旧版客户端)使用dc
+// 我们主动连接时总会创建ctrl,旧版客户端并不监听它,因此不能只看ctrl是否打开
+func (p *Peer) control() *webrtc.DataChannel {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.caps != nil && p.ctrl != nil && p.ctrl.ReadyState() == webrtc.DataChannelStateOpen {
+		return p.ctrl
+	}
+	return p.dc
+}
+
+// data 媒体数据使用的通道
+func (p *Peer) data() *webrtc.DataChannel {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.dc
+}
+
+// channels 获取ctrl和dc,二者可能在OnDataChannel回调中被替换
+func (p *Peer) channels() (*webrtc.DataChannel, *webrtc.DataChannel) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.ctrl, p.dc
+}
+
+// replyTo 回复控制消息的通道,对方发送过hello且ctrl已打开时使用ctrl,否则使用收到消息的通道d
+func (p *Peer) replyTo(d *webrtc.DataChannel) *webrtc.DataChannel {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.caps != nil && p.ctrl != nil && p.ctrl.ReadyState() == webrtc.DataChannelStateOpen {
+		return p.ctrl
+	}
+	return d
+}
+
+// sendTo 发送媒体数据的通道,dc还未打开或对方没有创建dc时使用收到消息的通道d
+func (p *Peer) sendTo(d *webrtc.DataChannel) *webrtc.DataChannel {
+	if c := p.data(); c != nil && c.ReadyState() == webrtc.DataChannelStateOpen {
+		return c
+	}
+	return d
+}
+
+// isControl d是否用于发送控制消息:ctrl通道,或旧版客户端没有ctrl通道时的dc
+func (p *Peer) isControl(d *webrtc.DataChannel) bool {
+	if d.Label() == ctrlLabel {
+		return true
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.ctrl == nil
+}
+
 // Close 关闭peerConection,和dataChannel,但是不影响共享的ws
 func (p *Peer) Close() error {
 	var err1 error
 	var err2 error
-	if p.dc != nil {
-		err1 = p.dc.Close()
+	vHub.Unsubscribe(p.id, "")
+	vHub.CancelPeer(p.id)
+	var ctrl, dc = p.channels()
+	if ctrl != nil {
+		err1 = ctrl.Close()
+	}
+	if dc != nil {
+		if err := dc.Close(); err1 == nil {
+			err1 = err
+		}
 	}
 	err2 = p.conn.Close()
 	if err1 != nil {
@@ -388,17 +704,85 @@ func (p *Peer) Close() error {
 	return err2
 }
 
-// Ping send ping to dc
+// sendHave 通知对方其订阅的视频流有分段进入了缓存
+func (p *Peer) sendHave(id string, index uint64) {
+	var d = p.control()
+	if d == nil || d.ReadyState() != webrtc.DataChannelStateOpen {
+		return
+	}
+	var v = &haveEvent{
+		Event: "have",
+		Data: vinfo{
+			ID:    id,
+			Index: index,
+		},
+	}
+	if err := sendJSON(d, v); err != nil {
+		util.Log.Print(err)
+	}
+}
+
+// Ping send ping to control channel
 func (p *Peer) Ping() error {
-	return sendPing(p.dc)
+	return p.ping(p.control())
+}
+
+func (p *Peer) ping(d *webrtc.DataChannel) error {
+	if d == nil {
+		return sendPing(d, 0, time.Time{})
+	}
+	seq, now := p.health.next()
+	return sendPing(d, seq, now)
+}
+
+// getCaps 获取协商后的能力,对方没有发送hello则按旧版协议
+func (p *Peer) getCaps() *video.Caps {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.caps == nil {
+		return video.LegacyCaps()
+	}
+	return p.caps
+}
+
+func (p *Peer) setCaps(caps *video.Caps) {
+	p.lock.Lock()
+	p.caps = caps
+	p.lock.Unlock()
+	util.Log.Printf("Peer %s hello version %d role %s chunk %d format %s", p.id, caps.Version, caps.Role, caps.Chunk, caps.Format())
+}
+
+// negotiated 对方是否发送过hello,旧版客户端不会回复ctrl上的ping
+func (p *Peer) negotiated() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.caps != nil
+}
+
+// ignoring 我们忽略了对方冲突的offer,此时对方的candidate无法加入
+func (p *Peer) ignoring() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.ignoreOffer
 }
 
-func initDc(d *webrtc.DataChannel) {
+func (p *Peer) lastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&p.active))
+}
+
+func (p *Peer) initDc(d *webrtc.DataChannel) {
 
 	// Register channel opening handling
 	d.OnOpen(func() {
 		util.Log.Printf("Data channel '%s'-'%d' open. \n", d.Label(), d.ID())
-		if err := sendPing(d); err != nil {
+		if !p.isControl(d) {
+			// 控制消息只通过ctrl发送,部分可靠的dc上丢失的ping会被计入丢失率
+			return
+		}
+		if err := sendHello(d); err != nil {
+			util.Log.Print(err)
+		}
+		if err := p.ping(d); err != nil {
 			util.Log.Print(err)
 		}
 	})
@@ -413,7 +797,13 @@ func initDc(d *webrtc.DataChannel) {
 
 	// Register text message handling
 	d.OnMessage(func(msg webrtc.DataChannelMessage) {
+		atomic.StoreInt64(&p.active, time.Now().UnixNano())
 		if msg.IsString {
+			if !gjson.ValidBytes(msg.Data) {
+				util.Log.Printf("Malformed message from DataChannel '%s'-'%d': '%s'\n", d.Label(), d.ID(), string(msg.Data))
+				blocklist.report(p.id, scoreMalformed, "malformed message")
+				return
+			}
 			g := gjson.ParseBytes(msg.Data)
 			ev := g.Get("event").String()
 			if ev == "query" {
@@ -422,22 +812,41 @@ func initDc(d *webrtc.DataChannel) {
 						Index: g.Get("data.index").Uint(),
 						ID:    g.Get("data.id").String(),
 					},
-					dc: d,
+					dc:   p.replyTo(d),
+					from: p.id,
+					caps: p.getCaps(),
 				}
 				return
 			} else if ev == "resolve" {
+				if !blocklist.allowResolve(p.id) {
+					return
+				}
+				chunks, ok := parseChunks(g.Get("data.chunks"))
+				if !ok {
+					blocklist.report(p.id, scoreMalformed, "malformed resolve chunks")
+					return
+				}
+				atomic.AddUint64(&p.served, 1)
 				dcResolveMsg <- &resolveEvent{
-					vinfo: vinfo{
-						Index: g.Get("data.index").Uint(),
-						ID:    g.Get("data.id").String(),
+					queryEvent: queryEvent{
+						vinfo: vinfo{
+							Index: g.Get("data.index").Uint(),
+							ID:    g.Get("data.id").String(),
+						},
+						dc:   p.sendTo(d),
+						from: p.id,
+						caps: p.getCaps(),
 					},
-					dc: d,
+					chunks:   chunks,
+					priority: int(g.Get("data.priority").Int()),
+					deadline: parseDeadline(g.Get("data.deadline")),
 				}
 				return
 			} else if ev == "ping" {
 				dcPingMsg <- &pingPongEvent{
 					Event: ev,
-					dc:    d,
+					dc:    p.replyTo(d),
+					data:  g.Get("data").Raw,
 				}
 				return
 			} else if ev == "quit" {
@@ -446,30 +855,63 @@ func initDc(d *webrtc.DataChannel) {
 						Index: g.Get("data.index").Uint(),
 						ID:    g.Get("data.id").String(),
 					},
-					dc: d,
+					dc:   p.sendTo(d),
+					from: p.id,
 				}
 				return
 			} else if ev == "pong" {
+				p.health.pong(g)
+				return
+			} else if ev == "subscribe" || ev == "unsubscribe" {
+				dcSubMsg <- &subscribeEvent{
+					peer: p,
+					id:   g.Get("data.id").String(),
+					on:   ev == "subscribe",
+				}
+				return
+			} else if ev == "batch" {
+				data := parseBatch(p.replyTo(d), g)
+				if data == nil {
+					blocklist.report(p.id, scoreMalformed, "malformed batch")
+					return
+				}
+				dcBatchMsg <- data
+				return
+			} else if ev == "hello" {
+				var remote *video.Caps
+				if err := json.Unmarshal([]byte(g.Get("data").Raw), &remote); err != nil || remote == nil {
+					blocklist.report(p.id, scoreMalformed, "malformed hello")
+					return
+				}
+				p.setCaps(video.Negotiate(remote))
 				return
 			}
 		}
 		util.Log.Printf("Message from DataChannel '%s'-'%d': '%s'\n", d.Label(), d.ID(), string(msg.Data))
-
+		blocklist.report(p.id, scoreUnknown, "unknown message")
 	})
 
 }
 
 func isPeerOk(peer *Peer) bool {
 	var cstatus = peer.conn.ConnectionState()
-	if cstatus == webrtc.PeerConnectionStateDisconnected || cstatus == webrtc.PeerConnectionStateClosed || cstatus == webrtc.PeerConnectionStateFailed {
+	if cstatus == webrtc.PeerConnectionStateClosed {
 		return false
 	}
 	var i = peer.conn.ICEConnectionState()
-	if i == webrtc.ICEConnectionStateDisconnected || i == webrtc.ICEConnectionStateFailed || i == webrtc.ICEConnectionStateClosed {
+	if i == webrtc.ICEConnectionStateClosed {
+		return false
+	}
+	if cstatus == webrtc.PeerConnectionStateDisconnected || cstatus == webrtc.PeerConnectionStateFailed || i == webrtc.ICEConnectionStateDisconnected || i == webrtc.ICEConnectionStateFailed {
+		// 短暂断开时正在尝试ICE restart,宽限期内仍认为可用
+		return peer.recovering()
+	}
+	var ctrl, dc = peer.channels()
+	if ctrl != nil && badDc(ctrl.ReadyState()) {
 		return false
 	}
-	if peer.dc != nil {
-		var dstatus = peer.dc.ReadyState()
+	if dc != nil {
+		var dstatus = dc.ReadyState()
 		if badDc(dstatus) {
 			return false
 		}
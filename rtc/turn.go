@@ -0,0 +1,167 @@
+package rtc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/turn/v2"
+)
+
+// startTurn 在进程内启动STUN/TURN服务,并将其加入ICE Server配置中,未配置TURN_PORT时不启动
+// 认证使用本节点的凭证:配置了TURN_SECRET则校验REST凭证,否则使用ICE_USERNAME/ICE_CREDENTIAL,都未配置时随机生成
+// 中继不与本机和内网地址通信,避免被用作访问内网的跳板
+func startTurn(ice *iceProvider) (*turn.Server, error) {
+	var sport = os.Getenv("TURN_PORT")
+	if sport == "" {
+		return nil, nil
+	}
+	port, err := strconv.Atoi(sport)
+	if err != nil {
+		return nil, err
+	}
+	var ip = net.ParseIP(strings.Split(os.Getenv("PUBLICIP"), ":")[0])
+	if ip == nil {
+		return nil, fmt.Errorf("TURN_PORT requires PUBLICIP")
+	}
+	var realm = os.Getenv("TURN_REALM")
+	if realm == "" {
+		realm = "videortc"
+	}
+	var addr = fmt.Sprintf("0.0.0.0:%d", port)
+	udpListener, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	tcpListener, err := net.Listen("tcp4", addr)
+	if err != nil {
+		udpListener.Close()
+		return nil, err
+	}
+	var generator = &relayGenerator{
+		RelayAddressGeneratorStatic: &turn.RelayAddressGeneratorStatic{
+			RelayAddress: ip,
+			Address:      "0.0.0.0",
+		},
+	}
+	if ice.secret == "" {
+		if ice.username == "" || ice.defaults {
+			// 默认ICE Server的凭证是公开的,不能用于内置TURN服务
+			ice.turnUser = randomString(8)
+			ice.turnCred = randomString(16)
+		} else {
+			ice.turnUser = ice.username
+			ice.turnCred = ice.credential
+		}
+	}
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       realm,
+		AuthHandler: turnAuthHandler(ice),
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn:            udpListener,
+				RelayAddressGenerator: generator,
+			},
+		},
+		ListenerConfigs: []turn.ListenerConfig{
+			{
+				Listener:              tcpListener,
+				RelayAddressGenerator: generator,
+			},
+		},
+	})
+	if err != nil {
+		udpListener.Close()
+		tcpListener.Close()
+		return nil, err
+	}
+	var host = net.JoinHostPort(ip.String(), sport)
+	ice.add("stun:" + host)
+	ice.addLocal("turn:" + host + "?transport=udp")
+	ice.addLocal("turn:" + host + "?transport=tcp")
+	return server, nil
+}
+
+// relayGenerator 分配的中继连接会丢弃与受限地址之间的数据
+type relayGenerator struct {
+	*turn.RelayAddressGeneratorStatic
+}
+
+// AllocatePacketConn 中继地址本身也受限,否则可通过公网地址访问本机的服务
+func (g *relayGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	conn, addr, err := g.RelayAddressGeneratorStatic.AllocatePacketConn(network, requestedPort)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &relayConn{PacketConn: conn, self: g.RelayAddress}, addr, nil
+}
+
+type relayConn struct {
+	net.PacketConn
+	self net.IP
+}
+
+// WriteTo 发往受限地址的数据直接丢弃
+func (c *relayConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.blocked(addr) {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// ReadFrom 丢弃来自受限地址的数据
+func (c *relayConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || !c.blocked(addr) {
+			return n, addr, err
+		}
+	}
+}
+
+func (c *relayConn) blocked(addr net.Addr) bool {
+	u, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return true
+	}
+	return blockedIP(u.IP) || u.IP.Equal(c.self)
+}
+
+var sharedNet = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// blockedIP 本机,内网,链路本地,组播和运营商级NAT地址
+func blockedIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || sharedNet.Contains(ip)
+}
+
+func turnAuthHandler(ice *iceProvider) turn.AuthHandler {
+	return func(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
+		if ice.secret == "" {
+			if ice.turnUser == "" || username != ice.turnUser {
+				return nil, false
+			}
+			return turn.GenerateAuthKey(username, realm, ice.turnCred), true
+		}
+		// REST凭证用户名形式为 过期时间戳:id
+		t, err := strconv.ParseInt(strings.Split(username, ":")[0], 10, 64)
+		if err != nil || time.Unix(t, 0).Before(time.Now()) {
+			return nil, false
+		}
+		mac := hmacSum(ice.secret, username)
+		return turn.GenerateAuthKey(username, realm, mac), true
+	}
+}
+
+func randomString(n int) string {
+	var bs = make([]byte, n)
+	if _, err := rand.Read(bs); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(bs)
+}
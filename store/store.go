@@ -0,0 +1,335 @@
+package store
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"videortc/util"
+)
+
+const (
+	indexFile = "index.json"
+	// 索引定期保存,两次保存之间的变更在崩溃后丢失,对应的数据文件在启动时清理
+	flushInterval = time.Second * 10
+	// 只有访问顺序变化时保存的间隔,访问顺序只影响重启后的淘汰顺序
+	recencyInterval = time.Minute * 5
+)
+
+// ErrTooLarge 数据超过了整个缓存的容量
+var ErrTooLarge = errors.New("data too large")
+
+// Store 磁盘分段缓存,容量超出时按LRU淘汰
+// 每次写入都使用新的数据文件,写完刷盘后才加入索引;索引按最近使用的顺序定期保存,先写临时文件再rename
+// 启动时丢弃索引与文件不一致的条目,删除不在索引中的文件,因此中途崩溃不会读到不完整的数据
+type Store struct {
+	dir      string
+	max      int64
+	size     int64
+	items    map[string]*list.Element
+	lru      *list.List // 最近使用的在前
+	hits     uint64
+	miss     uint64
+	dirty    bool      // 索引有未保存的增删
+	touched  bool      // 访问顺序有未保存的变化
+	saved    time.Time // 最近一次保存索引的时间
+	lock     *sync.Mutex
+	saveLock *sync.Mutex // 保证索引按顺序写入
+}
+
+// Item 索引中的一条记录
+type Item struct {
+	Key  string    `json:"key"`
+	File string    `json:"file"`
+	Size int64     `json:"size"`
+	Sum  string    `json:"sum"` // 数据的sha256
+	Time time.Time `json:"time"`
+}
+
+// Stat for store status
+type Stat struct {
+	Dir   string
+	Max   int64
+	Size  int64
+	Items int
+	Hits  uint64
+	Miss  uint64
+}
+
+// New 打开dir下的缓存,max为最大字节数
+func New(dir string, max int64) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var s = &Store{
+		dir:      dir,
+		max:      max,
+		items:    map[string]*list.Element{},
+		lru:      list.New(),
+		lock:     &sync.Mutex{},
+		saveLock: &sync.Mutex{},
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	go s.loop()
+	return s, nil
+}
+
+// load 读取索引,丢弃文件不存在或大小不符的条目,删除不在索引中的文件
+func (s *Store) load() error {
+	var items []*Item
+	bs, err := ioutil.ReadFile(filepath.Join(s.dir, indexFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err = json.Unmarshal(bs, &items); err != nil {
+			// 索引损坏时当作空缓存,下面会清理掉所有数据文件
+			util.Log.Print(err)
+			items = nil
+		}
+	}
+	var files = map[string]bool{}
+	for _, item := range items {
+		info, err := os.Stat(filepath.Join(s.dir, item.File))
+		if err != nil || info.Size() != item.Size || s.items[item.Key] != nil {
+			continue
+		}
+		files[item.File] = true
+		// 索引按最近使用的在前保存
+		s.items[item.Key] = s.lru.PushBack(item)
+		s.size += item.Size
+	}
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || e.Name() == indexFile || files[e.Name()] {
+			continue
+		}
+		if err = os.Remove(filepath.Join(s.dir, e.Name())); err != nil {
+			util.Log.Print(err)
+		}
+	}
+	s.remove(s.evict())
+	s.dirty = true
+	return s.Flush()
+}
+
+// Get 读取缓存的数据和其sha256
+func (s *Store) Get(key string) ([]byte, string, bool) {
+	s.lock.Lock()
+	e, ok := s.items[key]
+	if !ok {
+		s.miss++
+		s.lock.Unlock()
+		return nil, "", false
+	}
+	s.lru.MoveToFront(e)
+	var item = e.Value.(*Item)
+	item.Time = time.Now()
+	s.touched = true
+	var file, size, sum = item.File, item.Size, item.Sum
+	s.lock.Unlock()
+	bs, err := ioutil.ReadFile(filepath.Join(s.dir, file))
+	if err != nil || int64(len(bs)) != size {
+		// 文件可能刚被淘汰
+		s.lock.Lock()
+		s.miss++
+		s.lock.Unlock()
+		return nil, "", false
+	}
+	s.lock.Lock()
+	s.hits++
+	s.lock.Unlock()
+	return bs, sum, true
+}
+
+// Sum 已缓存数据的sha256和字节数,未缓存返回空
+func (s *Store) Sum(key string) (string, int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e, ok := s.items[key]; ok {
+		var item = e.Value.(*Item)
+		return item.Sum, item.Size
+	}
+	return "", 0
+}
+
+// Put 写入缓存,容量不足时淘汰最久未使用的
+// 数据先写入新文件,持锁时只替换索引中的条目,被替换和淘汰的文件在释放锁后删除,同一key并发写入不会删掉新文件
+func (s *Store) Put(key string, data []byte, sum string) error {
+	var size = int64(len(data))
+	if size > s.max {
+		return ErrTooLarge
+	}
+	file, err := createFile(s.dir, fileName(key), data)
+	if err != nil {
+		return err
+	}
+	var removed []string
+	s.lock.Lock()
+	if e, ok := s.items[key]; ok {
+		var old = e.Value.(*Item)
+		s.size -= old.Size
+		s.lru.Remove(e)
+		delete(s.items, key)
+		removed = append(removed, old.File)
+	}
+	s.items[key] = s.lru.PushFront(&Item{
+		Key:  key,
+		File: file,
+		Size: size,
+		Sum:  sum,
+		Time: time.Now(),
+	})
+	s.size += size
+	removed = append(removed, s.evict()...)
+	s.dirty = true
+	s.lock.Unlock()
+	s.remove(removed)
+	return nil
+}
+
+// evict 淘汰到容量以内,返回需删除的文件,需持有锁
+func (s *Store) evict() []string {
+	var files []string
+	for s.size > s.max {
+		e := s.lru.Back()
+		if e == nil {
+			break
+		}
+		var item = e.Value.(*Item)
+		s.lru.Remove(e)
+		delete(s.items, item.Key)
+		s.size -= item.Size
+		files = append(files, item.File)
+	}
+	return files
+}
+
+func (s *Store) remove(files []string) {
+	for _, file := range files {
+		if err := os.Remove(filepath.Join(s.dir, file)); err != nil && !os.IsNotExist(err) {
+			util.Log.Print(err)
+		}
+	}
+}
+
+func (s *Store) loop() {
+	var ticker = time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.save(false); err != nil {
+			util.Log.Print(err)
+		}
+	}
+}
+
+// Flush 索引或访问顺序有变更时保存,停止服务前调用
+func (s *Store) Flush() error {
+	return s.save(true)
+}
+
+// save 索引有增删时保存,只有访问顺序变化时all为true或距上次保存超过recencyInterval才保存
+// 持锁时只复制索引,序列化和写入在释放锁之后进行
+func (s *Store) save(all bool) error {
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+	var now = time.Now()
+	s.lock.Lock()
+	if !s.dirty && !(s.touched && (all || now.Sub(s.saved) >= recencyInterval)) {
+		s.lock.Unlock()
+		return nil
+	}
+	var items = make([]Item, 0, s.lru.Len())
+	for e := s.lru.Front(); e != nil; e = e.Next() {
+		items = append(items, *e.Value.(*Item))
+	}
+	s.dirty = false
+	s.touched = false
+	s.saved = now
+	s.lock.Unlock()
+	bs, err := json.Marshal(items)
+	if err == nil {
+		err = writeFile(s.dir, indexFile, bs)
+	}
+	if err != nil {
+		s.lock.Lock()
+		s.dirty = true
+		s.lock.Unlock()
+	}
+	return err
+}
+
+// Stats output status
+func (s *Store) Stats() *Stat {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return &Stat{
+		Dir:   s.dir,
+		Max:   s.max,
+		Size:  s.size,
+		Items: len(s.items),
+		Hits:  s.hits,
+		Miss:  s.miss,
+	}
+}
+
+// fileName key中含有 : | 等字符,使用其sha1作为文件名前缀
+func fileName(key string) string {
+	var sum = sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// createFile 写入名称以prefix开头的新文件并刷到磁盘,返回文件名
+func createFile(dir string, prefix string, data []byte) (string, error) {
+	f, err := ioutil.TempFile(dir, prefix+"-*.seg")
+	if err != nil {
+		return "", err
+	}
+	var name = f.Name()
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(name)
+		return "", err
+	}
+	return filepath.Base(name), nil
+}
+
+// writeFile 先写入临时文件并刷到磁盘,再rename覆盖目标文件
+func writeFile(dir string, name string, data []byte) error {
+	f, err := ioutil.TempFile(dir, strings.TrimSuffix(name, filepath.Ext(name))+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	var tmp = f.Name()
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,288 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func dataFiles(t *testing.T, dir string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, e := range entries {
+		if e.Name() != indexFile {
+			files = append(files, e.Name())
+		}
+	}
+	return files
+}
+
+func TestPutGet(t *testing.T) {
+	s, err := New(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put("vid:243|1", []byte("hello"), "sum1"); err != nil {
+		t.Fatal(err)
+	}
+	bs, sum, ok := s.Get("vid:243|1")
+	if !ok || string(bs) != "hello" || sum != "sum1" {
+		t.Fatalf("get %q %q %v", bs, sum, ok)
+	}
+	if _, _, ok = s.Get("vid:243|2"); ok {
+		t.Fatal("get missing key")
+	}
+	if sum, size := s.Sum("vid:243|1"); sum != "sum1" || size != 5 {
+		t.Fatalf("sum %q size %d", sum, size)
+	}
+	if st := s.Stats(); st.Hits != 1 || st.Miss != 1 || st.Items != 1 || st.Size != 5 {
+		t.Fatalf("stats %+v", st)
+	}
+	if err = s.Put("big", make([]byte, 101), ""); err != ErrTooLarge {
+		t.Fatalf("err %v, expected ErrTooLarge", err)
+	}
+}
+
+func TestEvictLRU(t *testing.T) {
+	var dir = t.TempDir()
+	s, err := New(dir, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data = bytes.Repeat([]byte{1}, 10)
+	for _, key := range []string{"a", "b", "c"} {
+		if err = s.Put(key, data, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 访问a后,最久未使用的是b
+	s.Get("a")
+	if err = s.Put("d", data, "d"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := s.Get("b"); ok {
+		t.Fatal("b not evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, _, ok := s.Get(key); !ok {
+			t.Fatalf("%s evicted", key)
+		}
+	}
+	if files := dataFiles(t, dir); len(files) != 3 {
+		t.Fatalf("files %v", files)
+	}
+}
+
+func TestPutSameKey(t *testing.T) {
+	var dir = t.TempDir()
+	s, err := New(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put("a", []byte("first"), "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put("a", []byte("second"), "2"); err != nil {
+		t.Fatal(err)
+	}
+	bs, sum, ok := s.Get("a")
+	if !ok || string(bs) != "second" || sum != "2" {
+		t.Fatalf("get %q %q %v", bs, sum, ok)
+	}
+	// 被替换的文件已删除
+	if files := dataFiles(t, dir); len(files) != 1 {
+		t.Fatalf("files %v", files)
+	}
+	if st := s.Stats(); st.Size != 6 {
+		t.Fatalf("size %d, expected 6", st.Size)
+	}
+}
+
+func TestPutSameKeyConcurrent(t *testing.T) {
+	var dir = t.TempDir()
+	// 容量只够两个条目,写入时不断淘汰
+	s, err := New(dir, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data = bytes.Repeat([]byte{1}, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				var key = "same"
+				if i%2 == 1 {
+					key = strings.Repeat("x", j%3+1)
+				}
+				if err := s.Put(key, data, key); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	// 索引中的每个条目都有对应的文件,size与文件一致
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var size int64
+	for e := s.lru.Front(); e != nil; e = e.Next() {
+		var item = e.Value.(*Item)
+		bs, err := ioutil.ReadFile(filepath.Join(dir, item.File))
+		if err != nil || int64(len(bs)) != item.Size {
+			t.Fatalf("item %s file %s: %v", item.Key, item.File, err)
+		}
+		size += item.Size
+	}
+	if size != s.size || s.size > s.max {
+		t.Fatalf("size %d, items %d, max %d", s.size, size, s.max)
+	}
+	if files := dataFiles(t, dir); len(files) != len(s.items) {
+		t.Fatalf("files %v, items %d", files, len(s.items))
+	}
+}
+
+func TestReopen(t *testing.T) {
+	var dir = t.TempDir()
+	s, err := New(dir, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data = bytes.Repeat([]byte{1}, 10)
+	for _, key := range []string{"a", "b", "c"} {
+		if err = s.Put(key, data, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Get("a")
+	if err = s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = New(dir, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 访问顺序在重启后保留,最久未使用的b被淘汰
+	if err = s.Put("d", data, "d"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := s.Get("b"); ok {
+		t.Fatal("b not evicted after reopen")
+	}
+	bs, sum, ok := s.Get("a")
+	if !ok || !bytes.Equal(bs, data) || sum != "a" {
+		t.Fatalf("get a %v %q %v", bs, sum, ok)
+	}
+}
+
+func TestReopenUnflushed(t *testing.T) {
+	var dir = t.TempDir()
+	s, err := New(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put("a", []byte("saved"), "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// 保存索引之前崩溃,新写入的文件不在索引中
+	if err = s.Put("b", []byte("lost"), "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "partial-1.tmp"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err = New(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := s.Get("a"); !ok {
+		t.Fatal("a lost after reopen")
+	}
+	if _, _, ok := s.Get("b"); ok {
+		t.Fatal("unflushed b present after reopen")
+	}
+	if files := dataFiles(t, dir); len(files) != 1 {
+		t.Fatalf("files %v, expected only a", files)
+	}
+}
+
+func TestReopenTruncatedFile(t *testing.T) {
+	var dir = t.TempDir()
+	s, err := New(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put("a", []byte("hello"), "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var file = s.items["a"].Value.(*Item).File
+	if err = ioutil.WriteFile(filepath.Join(dir, file), []byte("hel"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err = New(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := s.Get("a"); ok {
+		t.Fatal("truncated file served")
+	}
+	if st := s.Stats(); st.Size != 0 || st.Items != 0 {
+		t.Fatalf("stats %+v", st)
+	}
+}
+
+func TestGetNotDirty(t *testing.T) {
+	var dir = t.TempDir()
+	s, err := New(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err = s.Put(key, []byte(key), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var first = func() string {
+		bs, err := ioutil.ReadFile(filepath.Join(dir, indexFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var items []*Item
+		if err = json.Unmarshal(bs, &items); err != nil || len(items) == 0 {
+			t.Fatalf("index %s: %v", bs, err)
+		}
+		return items[0].Key
+	}
+	s.Get("a")
+	// 只有访问顺序变化时定期保存不会重写索引
+	if err = s.save(false); err != nil {
+		t.Fatal(err)
+	}
+	if key := first(); key != "b" {
+		t.Fatalf("index rewritten after get, first %s", key)
+	}
+	if err = s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if key := first(); key != "a" {
+		t.Fatalf("recency not saved by flush, first %s", key)
+	}
+}
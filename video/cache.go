@@ -0,0 +1,142 @@
+package video
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"videortc/request"
+	"videortc/store"
+	"videortc/util"
+)
+
+var (
+	// diskCache 磁盘分段缓存,未配置CACHE_DIR时为nil
+	diskCache = openStore()
+	// persisting 正在写入磁盘缓存的分段
+	persisting sync.Map
+)
+
+func openStore() *store.Store {
+	var dir = os.Getenv("CACHE_DIR")
+	if dir == "" {
+		return nil
+	}
+	var max int64 = 1024 * 1024 * 1024
+	if s := os.Getenv("CACHE_SIZE"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n <= 0 {
+			panic(fmt.Errorf("error CACHE_SIZE %s", s))
+		}
+		max = n
+	}
+	s, err := store.New(dir, max)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// FlushCache 保存磁盘缓存的索引,停止服务前调用
+func FlushCache() error {
+	if diskCache == nil {
+		return nil
+	}
+	return diskCache.Flush()
+}
+
+// memCacheSize 内存分段缓存的最大字节数,默认64MB
+func memCacheSize() int64 {
+	var s = os.Getenv("MEM_CACHE_SIZE")
+	if s == "" {
+		return 64 * 1024 * 1024
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		panic(fmt.Errorf("error MEM_CACHE_SIZE %s", s))
+	}
+	return n
+}
+
+// CacheStats 内存分段缓存的状态
+func CacheStats() *request.CacheStat {
+	return httpProvider.Stats()
+}
+
+func segmentKey(id string, index uint64) string {
+	return fmt.Sprintf("%s|%d", id, index)
+}
+
+// openSegment 优先从磁盘缓存读取,否则从上游边下载边读取,下载完成后写入磁盘缓存,使用完毕后需Release
+// peer为请求此分段的Peer,分段进入缓存时不通知它,为空时通知所有订阅者
+func openSegment(peer string, id string, index uint64, target *request.Target) (*request.Stream, error) {
+	var key = segmentKey(id, index)
+	if diskCache != nil {
+		if bs, sum, ok := diskCache.Get(key); ok && len(bs) == target.Size {
+			return request.NewBufferStream(request.NewBuffer(bs), sum), nil
+		}
+	}
+	st, err := httpProvider.Stream(target)
+	if err != nil {
+		return nil, err
+	}
+	if diskCache != nil {
+		go persist(peer, id, index, st.Observe())
+	} else if st.Fetched() {
+		go announce(peer, id, index, st.Observe())
+	}
+	return st, nil
+}
+
+// announce 没有磁盘缓存时,等待由此请求发起的下载完成后通知订阅者
+func announce(peer string, id string, index uint64, st *request.Stream) {
+	defer st.Release()
+	if _, _, err := st.All(context.Background()); err != nil {
+		return
+	}
+	haves.publish(id, index, peer)
+}
+
+// persist 等待下载完成后写入磁盘缓存并通知订阅者,同一分段同时只有一个写入;不会让下载继续,发送方都离开后下载中止,不再写入
+func persist(peer string, id string, index uint64, st *request.Stream) {
+	defer st.Release()
+	var key = segmentKey(id, index)
+	if _, loaded := persisting.LoadOrStore(key, true); loaded {
+		return
+	}
+	defer persisting.Delete(key)
+	bs, sum, err := st.All(context.Background())
+	if err != nil {
+		// 下载失败时发送方会记录错误
+		return
+	}
+	if s, _ := diskCache.Sum(key); s == sum {
+		return
+	}
+	if err = diskCache.Put(key, bs, sum); err != nil {
+		util.Log.Print(err)
+		return
+	}
+	haves.publish(id, index, peer)
+}
+
+// cachedSum 已在内存或磁盘缓存中的分段的sha256,未缓存返回空
+func cachedSum(id string, index uint64, target *request.Target) string {
+	if sum := httpProvider.Sum(target.URL); sum != "" {
+		return sum
+	}
+	if diskCache != nil {
+		if sum, size := diskCache.Sum(segmentKey(id, index)); size == int64(target.Size) {
+			return sum
+		}
+	}
+	return ""
+}
+
+func storeStats() *store.Stat {
+	if diskCache == nil {
+		return nil
+	}
+	return diskCache.Stats()
+}
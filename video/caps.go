@@ -0,0 +1,83 @@
+package video
+
+// ProtocolVersion DataChannel协议版本
+const ProtocolVersion = 1
+
+// FormatLegacy 30字节JSON头部的分片格式
+const FormatLegacy = "legacy"
+
+// Caps 协议能力,DataChannel打开时双方通过hello交换
+type Caps struct {
+	Version int      `json:"version"`
+	Role    string   `json:"role"`
+	Chunk   int      `json:"chunk"`   // 每个分片最大的数据字节数
+	Formats []string `json:"formats"` // 支持的分片头部格式,按优先顺序
+	Batch   bool     `json:"batch"`   // 支持批量查询
+	Have    bool     `json:"have"`    // 支持订阅视频流并接收have通知
+}
+
+// LocalCaps 本节点支持的能力
+func LocalCaps() *Caps {
+	return &Caps{
+		Version: ProtocolVersion,
+		Role:    "node",
+		Chunk:   chunk,
+		Formats: []string{FormatBinary, FormatLegacy},
+		Batch:   true,
+		Have:    true,
+	}
+}
+
+// LegacyCaps 没有发送hello的旧版客户端,只支持最初的协议
+func LegacyCaps() *Caps {
+	return &Caps{
+		Version: 0,
+		Role:    "peer",
+		Chunk:   chunk,
+		Formats: []string{FormatLegacy},
+	}
+}
+
+// Negotiate 根据对方的能力得出双方都支持的部分
+func Negotiate(remote *Caps) *Caps {
+	var local = LocalCaps()
+	var res = &Caps{
+		Version: local.Version,
+		Role:    remote.Role,
+		Chunk:   local.Chunk,
+		Formats: []string{FormatLegacy},
+		Batch:   local.Batch && remote.Batch,
+		Have:    local.Have && remote.Have,
+	}
+	if remote.Version < res.Version {
+		res.Version = remote.Version
+	}
+	// 对方能接收的分片更小时按对方的,过小的值忽略
+	if remote.Chunk >= 1024 && remote.Chunk < res.Chunk {
+		res.Chunk = remote.Chunk
+	}
+	for _, f := range local.Formats {
+		if remote.supports(f) {
+			res.Formats = []string{f}
+			break
+		}
+	}
+	return res
+}
+
+// Format 协商后使用的分片格式
+func (c *Caps) Format() string {
+	if len(c.Formats) == 0 {
+		return FormatLegacy
+	}
+	return c.Formats[0]
+}
+
+func (c *Caps) supports(format string) bool {
+	for _, f := range c.Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package video
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// FormatBinary 长度前缀的二进制分片头部
+const FormatBinary = "bin1"
+
+const (
+	legacyHeaderSize = 30
+	frameVersion     = 1
+	// magic(2) version(1) flags(1) hlen(2) idlen(2)
+	framePrefixSize = 8
+	// index(4) i(4) n(4) offset(8) total(8)
+	frameFieldsSize = 28
+	// flags中此位表示头部末尾带有32字节的sha256
+	frameFlagSum = 0x01
+	// flags中此位表示此分段发送失败,没有数据,对方应丢弃已收到的分片
+	frameFlagError = 0x02
+)
+
+var (
+	frameMagic = [2]byte{'V', 'R'}
+	// ErrHeaderOverflow 旧版头部超过30字节,发送出去会破坏对方的组装
+	ErrHeaderOverflow = errors.New("chunk header overflow")
+)
+
+// frame 一个分片的头部信息
+type frame struct {
+	id     string // vid:itag
+	index  uint64 // 分段序号
+	i      int    // 分片序号,从0开始
+	n      int    // 总分片数
+	offset int    // 此分片在分段中的字节偏移
+	total  int    // 分段总字节数
+	sum    []byte // 分段的sha256,仅最后一个分片携带
+	failed bool   // 错误帧,仅二进制头部支持
+}
+
+// header 按协商的格式生成分片头部
+func (f *frame) header(format string) ([]byte, error) {
+	if format == FormatBinary {
+		return f.binaryHeader()
+	}
+	return f.legacyHeader()
+}
+
+// 自定义分片协议,前端按照此协议组装,header头必须30字符
+// ["id",i,l]
+// id = vid:itag|index
+func (f *frame) legacyHeader() ([]byte, error) {
+	var header = fmt.Sprintf(`["%s|%d",%d,%d]`, f.id, f.index, f.i, f.n)
+	if len(header) > legacyHeaderSize {
+		return nil, fmt.Errorf("%w: %s", ErrHeaderOverflow, header)
+	}
+	return []byte(fmt.Sprintf("%-30s", header)), nil
+}
+
+// 二进制分片头部,整数均为大端序
+// magic   2 bytes "VR"
+// version 1 byte
+// flags   1 byte  0x01 头部末尾带有sha256, 0x02 错误帧,没有数据
+// hlen    2 bytes 头部总长度,数据从此处开始
+// idlen   2 bytes
+// id      idlen bytes, vid:itag
+// index   4 bytes 分段序号
+// i       4 bytes 分片序号
+// n       4 bytes 总分片数
+// offset  8 bytes 此分片在分段中的字节偏移
+// total   8 bytes 分段总字节数
+// sum     32 bytes 分段的sha256, 仅 flags&0x01 时存在
+func (f *frame) binaryHeader() ([]byte, error) {
+	var (
+		idlen = len(f.id)
+		hlen  = framePrefixSize + idlen + frameFieldsSize + len(f.sum)
+		flags byte
+	)
+	if len(f.sum) > 0 {
+		flags |= frameFlagSum
+	}
+	if f.failed {
+		flags |= frameFlagError
+	}
+	if hlen > math.MaxUint16 || f.index > math.MaxUint32 {
+		return nil, fmt.Errorf("%w: %s|%d", ErrHeaderOverflow, f.id, f.index)
+	}
+	var bs = make([]byte, hlen)
+	copy(bs, frameMagic[:])
+	bs[2] = frameVersion
+	bs[3] = flags
+	binary.BigEndian.PutUint16(bs[4:], uint16(hlen))
+	binary.BigEndian.PutUint16(bs[6:], uint16(idlen))
+	copy(bs[framePrefixSize:], f.id)
+	var p = bs[framePrefixSize+idlen:]
+	binary.BigEndian.PutUint32(p[0:], uint32(f.index))
+	binary.BigEndian.PutUint32(p[4:], uint32(f.i))
+	binary.BigEndian.PutUint32(p[8:], uint32(f.n))
+	binary.BigEndian.PutUint64(p[12:], uint64(f.offset))
+	binary.BigEndian.PutUint64(p[20:], uint64(f.total))
+	copy(p[frameFieldsSize:], f.sum)
+	return bs, nil
+}
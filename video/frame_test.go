@@ -0,0 +1,102 @@
+package video
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLegacyHeader(t *testing.T) {
+	var f = &frame{id: "abcdefghijk:243", index: 12, i: 3, n: 40}
+	bs, err := f.header(FormatLegacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bs) != legacyHeaderSize {
+		t.Fatalf("header size %d, expected %d", len(bs), legacyHeaderSize)
+	}
+	if got := strings.TrimRight(string(bs), " "); got != `["abcdefghijk:243|12",3,40]` {
+		t.Fatalf("header %q", got)
+	}
+}
+
+func TestLegacyHeaderOverflow(t *testing.T) {
+	var f = &frame{id: "abcdefghijk:243", index: 123456, i: 1000, n: 1000}
+	if _, err := f.header(FormatLegacy); !errors.Is(err, ErrHeaderOverflow) {
+		t.Fatalf("err %v, expected ErrHeaderOverflow", err)
+	}
+}
+
+func TestBinaryHeader(t *testing.T) {
+	var sum = bytes.Repeat([]byte{0xab}, 32)
+	for _, f := range []*frame{
+		{id: "abcdefghijk:243", index: 12, i: 3, n: 40, offset: 153600, total: 2048000},
+		{id: "abcdefghijk:243", index: 12, i: 39, n: 40, offset: 1996800, total: 2048000, sum: sum},
+	} {
+		bs, err := f.header(FormatBinary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var idlen = len(f.id)
+		if len(bs) != framePrefixSize+idlen+frameFieldsSize+len(f.sum) {
+			t.Fatalf("header size %d", len(bs))
+		}
+		if string(bs[:2]) != "VR" || bs[2] != frameVersion {
+			t.Fatalf("magic %q version %d", bs[:2], bs[2])
+		}
+		if hasSum := bs[3]&frameFlagSum != 0; hasSum != (len(f.sum) > 0) {
+			t.Fatalf("flags %x", bs[3])
+		}
+		if hlen := binary.BigEndian.Uint16(bs[4:]); int(hlen) != len(bs) {
+			t.Fatalf("hlen %d, expected %d", hlen, len(bs))
+		}
+		if n := binary.BigEndian.Uint16(bs[6:]); int(n) != idlen {
+			t.Fatalf("idlen %d", n)
+		}
+		if id := string(bs[framePrefixSize : framePrefixSize+idlen]); id != f.id {
+			t.Fatalf("id %q", id)
+		}
+		var p = bs[framePrefixSize+idlen:]
+		if v := binary.BigEndian.Uint32(p[0:]); uint64(v) != f.index {
+			t.Fatalf("index %d", v)
+		}
+		if v := binary.BigEndian.Uint32(p[4:]); int(v) != f.i {
+			t.Fatalf("i %d", v)
+		}
+		if v := binary.BigEndian.Uint32(p[8:]); int(v) != f.n {
+			t.Fatalf("n %d", v)
+		}
+		if v := binary.BigEndian.Uint64(p[12:]); int(v) != f.offset {
+			t.Fatalf("offset %d", v)
+		}
+		if v := binary.BigEndian.Uint64(p[20:]); int(v) != f.total {
+			t.Fatalf("total %d", v)
+		}
+		if !bytes.Equal(p[frameFieldsSize:], f.sum) {
+			t.Fatalf("sum %x", p[frameFieldsSize:])
+		}
+	}
+}
+
+func TestBinaryHeaderOverflow(t *testing.T) {
+	var f = &frame{id: "abcdefghijk:243", index: 1 << 32}
+	if _, err := f.header(FormatBinary); !errors.Is(err, ErrHeaderOverflow) {
+		t.Fatalf("err %v, expected ErrHeaderOverflow", err)
+	}
+}
+
+func TestBinaryErrorFrame(t *testing.T) {
+	var f = &frame{id: "abcdefghijk:243", index: 12, i: 39, n: 40, offset: 1996800, total: 2048000, failed: true}
+	bs, err := f.header(FormatBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs[3] != frameFlagError {
+		t.Fatalf("flags %x", bs[3])
+	}
+	if hlen := binary.BigEndian.Uint16(bs[4:]); int(hlen) != framePrefixSize+len(f.id)+frameFieldsSize {
+		t.Fatalf("hlen %d", hlen)
+	}
+}
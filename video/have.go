@@ -0,0 +1,125 @@
+package video
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// 同一分段在此时间内只通知一次
+	announceInterval = time.Second * 30
+	// 每个订阅者最多订阅的视频流数量
+	maxSubscribe = 8
+)
+
+var haves = newHaveHub()
+
+// haveHub 记录订阅了视频流的Peer,当此视频流的分段进入缓存时通知他们
+type haveHub struct {
+	subs      map[string]map[string]func(id string, index uint64) // vid:itag => 订阅者 => 回调
+	announced map[string]time.Time
+	time      time.Time
+	lock      *sync.Mutex
+}
+
+func newHaveHub() *haveHub {
+	return &haveHub{
+		subs:      map[string]map[string]func(id string, index uint64){},
+		announced: map[string]time.Time{},
+		time:      time.Now(),
+		lock:      &sync.Mutex{},
+	}
+}
+
+func (h *haveHub) subscribe(key string, id string, fn func(id string, index uint64)) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.subs[id][key]; ok {
+		// 已订阅,重复订阅不计入数量
+		h.subs[id][key] = fn
+		return nil
+	}
+	var n = 0
+	for _, subs := range h.subs {
+		if _, ok := subs[key]; ok {
+			n++
+		}
+	}
+	if n >= maxSubscribe {
+		return fmt.Errorf("%s subscribe too many streams", key)
+	}
+	subs, ok := h.subs[id]
+	if !ok {
+		subs = map[string]func(id string, index uint64){}
+		h.subs[id] = subs
+	}
+	subs[key] = fn
+	return nil
+}
+
+// unsubscribe id为空时取消此订阅者的所有订阅
+func (h *haveHub) unsubscribe(key string, id string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for sid, subs := range h.subs {
+		if id != "" && sid != id {
+			continue
+		}
+		delete(subs, key)
+		if len(subs) == 0 {
+			delete(h.subs, sid)
+		}
+	}
+}
+
+// publish 分段已进入缓存,通知此视频流的订阅者,skip为请求此分段的订阅者,它已收到此分段,不通知
+func (h *haveHub) publish(id string, index uint64, skip string) {
+	var (
+		now = time.Now()
+		key = fmt.Sprintf("%s|%d", id, index)
+		fns []func(id string, index uint64)
+	)
+	h.lock.Lock()
+	h.clean(now)
+	if t, ok := h.announced[key]; ok && now.Sub(t) < announceInterval {
+		h.lock.Unlock()
+		return
+	}
+	h.announced[key] = now
+	for key, fn := range h.subs[id] {
+		if key != skip {
+			fns = append(fns, fn)
+		}
+	}
+	h.lock.Unlock()
+	for _, fn := range fns {
+		fn(id, index)
+	}
+}
+
+// clean 需持有锁
+func (h *haveHub) clean(now time.Time) {
+	if now.Sub(h.time) < announceInterval {
+		return
+	}
+	for key, t := range h.announced {
+		if now.Sub(t) >= announceInterval {
+			delete(h.announced, key)
+		}
+	}
+	h.time = now
+}
+
+// Subscribe 订阅视频流(vid:itag),此视频流的分段进入缓存时调用fn, key为订阅者标识
+func (m *MediaHub) Subscribe(key string, id string, fn func(id string, index uint64)) error {
+	if _, _, err := m.getVideoInfo(id); err != nil {
+		return err
+	}
+	return haves.subscribe(key, id, fn)
+}
+
+// Unsubscribe 取消订阅,id为空时取消此订阅者的所有订阅
+func (m *MediaHub) Unsubscribe(key string, id string) {
+	haves.unsubscribe(key, id)
+}
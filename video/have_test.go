@@ -0,0 +1,47 @@
+package video
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHavePublishSkipsRequester(t *testing.T) {
+	var (
+		h        = newHaveHub()
+		notified = map[string]int{}
+	)
+	for _, key := range []string{"a", "b"} {
+		var key = key
+		if err := h.subscribe(key, "vid:243", func(id string, index uint64) {
+			notified[key]++
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.publish("vid:243", 1, "a")
+	if notified["a"] != 0 || notified["b"] != 1 {
+		t.Fatalf("notified %v", notified)
+	}
+	// 同一分段在间隔内只通知一次
+	h.publish("vid:243", 1, "")
+	if notified["b"] != 1 {
+		t.Fatalf("notified %v", notified)
+	}
+}
+
+func TestHaveResubscribe(t *testing.T) {
+	var h = newHaveHub()
+	var fn = func(id string, index uint64) {}
+	for i := 0; i < maxSubscribe; i++ {
+		if err := h.subscribe("a", fmt.Sprintf("vid:%d", i), fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 已订阅的视频流再次订阅不受数量限制
+	if err := h.subscribe("a", "vid:0", fn); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.subscribe("a", "vid:new", fn); err == nil {
+		t.Fatal("subscribe over limit")
+	}
+}
@@ -0,0 +1,174 @@
+package video
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"videortc/request"
+	"videortc/util"
+
+	"github.com/suconghou/youtubevideoparser"
+)
+
+var prefetch = newPrefetcher(envInt("PREFETCH", 2), envInt("PREFETCH_CONCURRENCY", 4), memCacheSize()/4)
+
+// PrefetchStat for prefetch status
+type PrefetchStat struct {
+	Depth    int
+	Jobs     int
+	Pending  int64 // 排队和下载中的字节数
+	Fetched  uint64
+	Canceled uint64
+}
+
+// prefetcher 对方resolve一个分段后,预先获取之后的几个分段到缓存中
+type prefetcher struct {
+	depth    int
+	sem      chan struct{} // 限制同时下载的数量
+	budget   int64         // 排队和下载中的字节数上限
+	pending  int64
+	jobs     map[string]*prefetchJob // vid:itag|index => job
+	fetched  uint64
+	canceled uint64
+	lock     *sync.Mutex
+}
+
+type prefetchJob struct {
+	id     string
+	peers  map[string]bool // 需要此分段的Peer,都取消后此任务取消
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func envInt(name string, value int) int {
+	var s = os.Getenv(name)
+	if s == "" {
+		return value
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		panic(fmt.Errorf("error %s %s", name, s))
+	}
+	return n
+}
+
+func newPrefetcher(depth int, concurrency int, budget int64) *prefetcher {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &prefetcher{
+		depth:  depth,
+		sem:    make(chan struct{}, concurrency),
+		budget: budget,
+		jobs:   map[string]*prefetchJob{},
+		lock:   &sync.Mutex{},
+	}
+}
+
+// start 预取index之后的depth个分段,只使用已解析的索引,已缓存的跳过,超出预算时停止
+func (p *prefetcher) start(peer string, id string, vid string, item *youtubevideoparser.StreamItem, index uint64) {
+	for i := uint64(1); i <= uint64(p.depth); i++ {
+		var n = index + i
+		target := request.CachedIndex(vid, item, int(n))
+		if target == nil {
+			return
+		}
+		if cachedSum(id, n, target) != "" {
+			continue
+		}
+		var key = segmentKey(id, n)
+		p.lock.Lock()
+		if job, ok := p.jobs[key]; ok {
+			job.peers[peer] = true
+			p.lock.Unlock()
+			continue
+		}
+		if p.pending+int64(target.Size) > p.budget {
+			p.lock.Unlock()
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		var job = &prefetchJob{
+			id:     id,
+			peers:  map[string]bool{peer: true},
+			ctx:    ctx,
+			cancel: cancel,
+		}
+		p.jobs[key] = job
+		p.pending += int64(target.Size)
+		p.lock.Unlock()
+		go p.run(key, id, n, target, job)
+	}
+}
+
+func (p *prefetcher) run(key string, id string, index uint64, target *request.Target, job *prefetchJob) {
+	defer func() {
+		p.lock.Lock()
+		if p.jobs[key] == job {
+			delete(p.jobs, key)
+		}
+		p.pending -= int64(target.Size)
+		p.lock.Unlock()
+		job.cancel()
+	}()
+	select {
+	case p.sem <- struct{}{}:
+	case <-job.ctx.Done():
+		atomic.AddUint64(&p.canceled, 1)
+		return
+	}
+	defer func() {
+		<-p.sem
+	}()
+	if job.ctx.Err() != nil {
+		atomic.AddUint64(&p.canceled, 1)
+		return
+	}
+	// 下载与其他请求共享,取消时只是此预取离开,所有读取者都离开后下载才会中止
+	st, err := openSegment("", id, index, target)
+	if err != nil {
+		util.Log.Print(err)
+		return
+	}
+	defer st.Release()
+	if _, _, err = st.All(job.ctx); err != nil {
+		if job.ctx.Err() != nil {
+			atomic.AddUint64(&p.canceled, 1)
+		} else {
+			util.Log.Print(err)
+		}
+		return
+	}
+	atomic.AddUint64(&p.fetched, 1)
+}
+
+// cancel 取消此Peer对id的所有预取,包括已开始的下载;id为空时取消此Peer的所有预取
+func (p *prefetcher) cancel(peer string, id string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, job := range p.jobs {
+		if !job.peers[peer] || (id != "" && job.id != id) {
+			continue
+		}
+		delete(job.peers, peer)
+		if len(job.peers) == 0 {
+			job.cancel()
+		}
+	}
+}
+
+func (p *prefetcher) stats() *PrefetchStat {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return &PrefetchStat{
+		Depth:    p.depth,
+		Jobs:     len(p.jobs),
+		Pending:  p.pending,
+		Fetched:  atomic.LoadUint64(&p.fetched),
+		Canceled: atomic.LoadUint64(&p.canceled),
+	}
+}
@@ -2,8 +2,14 @@ package video
 
 import (
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"os"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 	"videortc/request"
 	"videortc/util"
@@ -11,24 +17,40 @@ import (
 	"github.com/pion/webrtc/v3"
 )
 
-const maxBufferedAmount uint64 = 1024 * 1024 // 1 MB
 const chunk = 51200
 
 var (
-	queueManager = newdcQueueManager()
-	httpProvider = request.NewLockGeter(time.Second * 5)
+	errClosed = errors.New("datachannel closed")
+	// DataChannel缓冲超过高水位时暂停发送,降到低水位以下时继续
+	highWater, lowWater = bufferWaterMarks()
+	queueManager        = newdcQueueManager()
+	httpProvider        = request.NewLockGeter(time.Minute*10, memCacheSize())
 )
 
 type dcQueueManager struct {
 	dcConnections sync.Map
 }
 
+// queueKey SCTP stream ID只在同一连接内唯一,不同Peer的DataChannel可能ID相同,因此按Peer和DataChannel实例区分队列
+type queueKey struct {
+	peer string
+	dc   *webrtc.DataChannel
+}
+
 type dcQueue struct {
-	dc     *webrtc.DataChannel
-	tasks  []*bufferTask
-	lock   *sync.RWMutex
-	ctx    context.Context
-	cancel context.CancelFunc
+	peer    string
+	dc      *webrtc.DataChannel
+	tasks   []*bufferTask
+	current *bufferTask // 正在执行的任务,quit时也需取消
+	lock    *sync.RWMutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	notify  chan struct{} // 有新任务时通知loopTask
+	low     chan struct{} // 缓冲降到低水位时通知
+	running int32         // 正在执行doTask
+	missed  uint64        // 超过截止时间而丢弃的任务数
+	sent    uint64        // 已发送的字节数
+	vtime   float64       // 调度器中的虚拟完成时间,由调度器持锁读写
 }
 
 // ItemStat for queue status
@@ -37,6 +59,8 @@ type ItemStat struct {
 	Label    string
 	State    string
 	Tasks    int
+	Missed   uint64
+	Sent     uint64
 	Buffered uint64
 }
 
@@ -46,15 +70,22 @@ func newdcQueueManager() *dcQueueManager {
 	}
 }
 
-// dcQueueManager 维护所有datachannel到dcConnections里,每个datachannel对应一个dcQueue
-func (q *dcQueueManager) send(d *webrtc.DataChannel, buffer *bufferTask) {
+// dcQueueManager 维护所有datachannel到dcConnections里,每个Peer的每个datachannel对应一个dcQueue
+func (q *dcQueueManager) send(peer string, d *webrtc.DataChannel, buffer *bufferTask) {
+	if d == nil {
+		buffer.cancel()
+		return
+	}
 	ctx, cancel := context.WithCancel(context.Background())
-	t, loaded := q.dcConnections.LoadOrStore(fmt.Sprintf("%d", d.ID()), &dcQueue{
-		d,
-		[]*bufferTask{},
-		&sync.RWMutex{},
-		ctx,
-		cancel,
+	t, loaded := q.dcConnections.LoadOrStore(queueKey{peer, d}, &dcQueue{
+		peer:   peer,
+		dc:     d,
+		tasks:  []*bufferTask{},
+		notify: make(chan struct{}, 1),
+		low:    make(chan struct{}, 1),
+		lock:   &sync.RWMutex{},
+		ctx:    ctx,
+		cancel: cancel,
 	})
 	v := t.(*dcQueue)
 	v.addTask(buffer)
@@ -63,6 +94,13 @@ func (q *dcQueueManager) send(d *webrtc.DataChannel, buffer *bufferTask) {
 		return
 	}
 	// 否则,是我们本次新建的队列,我们需要启动此队列
+	d.SetBufferedAmountLowThreshold(lowWater)
+	d.OnBufferedAmountLow(func() {
+		select {
+		case v.low <- struct{}{}:
+		default:
+		}
+	})
 	go func() {
 		v.loopTask()
 		q.clean()
@@ -73,7 +111,7 @@ func (q *dcQueueManager) send(d *webrtc.DataChannel, buffer *bufferTask) {
 func (q *dcQueueManager) clean() {
 	q.dcConnections.Range(func(key, value interface{}) bool {
 		var item = value.(*dcQueue)
-		if item.dc.ReadyState() == webrtc.DataChannelStateClosed || item.dc.ReadyState() == webrtc.DataChannelStateClosing {
+		if badDc(item.dc.ReadyState()) {
 			item.cancel()
 			q.dcConnections.Delete(key)
 		}
@@ -81,69 +119,161 @@ func (q *dcQueueManager) clean() {
 	})
 }
 
-func (q *dcQueueManager) quit(d *webrtc.DataChannel, id string, index uint64) {
-	v, ok := q.dcConnections.Load(fmt.Sprintf("%d", d.ID()))
+func (q *dcQueueManager) quit(peer string, d *webrtc.DataChannel, id string, index uint64) {
+	v, ok := q.dcConnections.Load(queueKey{peer, d})
 	if !ok {
 		return
 	}
 	v.(*dcQueue).quit(id, index)
 }
 
-func (q *dcQueueManager) stats() map[string]*ItemStat {
-	var res = map[string]*ItemStat{}
+// idle 所有队列都没有待执行和执行中的任务
+func (q *dcQueueManager) idle() bool {
+	var idle = true
+	q.dcConnections.Range(func(key, value interface{}) bool {
+		var item = value.(*dcQueue)
+		if badDc(item.dc.ReadyState()) {
+			return true
+		}
+		item.lock.RLock()
+		var l = len(item.tasks)
+		item.lock.RUnlock()
+		if l > 0 || atomic.LoadInt32(&item.running) == 1 {
+			idle = false
+			return false
+		}
+		return true
+	})
+	return idle
+}
+
+// cancelAll 取消所有队列的任务
+func (q *dcQueueManager) cancelAll() {
+	q.dcConnections.Range(func(key, value interface{}) bool {
+		var item = value.(*dcQueue)
+		item.rmTask("", 0)
+		item.cancel()
+		q.dcConnections.Delete(key)
+		return true
+	})
+}
+
+// cancelPeer 取消此Peer所有队列的任务
+func (q *dcQueueManager) cancelPeer(peer string) {
+	q.dcConnections.Range(func(key, value interface{}) bool {
+		var item = value.(*dcQueue)
+		if item.peer != peer {
+			return true
+		}
+		item.rmTask("", 0)
+		item.cancel()
+		q.dcConnections.Delete(key)
+		return true
+	})
+}
+
+// stats 按Peer分组的队列状态
+func (q *dcQueueManager) stats() map[string][]*ItemStat {
+	var res = map[string][]*ItemStat{}
 	q.dcConnections.Range(func(key, value interface{}) bool {
 		v := value.(*dcQueue)
-		res[key.(string)] = &ItemStat{
+		res[v.peer] = append(res[v.peer], &ItemStat{
 			ID:       fmt.Sprintf("%d", v.dc.ID()),
 			Label:    v.dc.Label(),
 			Buffered: v.dc.BufferedAmount(),
 			State:    v.dc.ReadyState().String(),
 			Tasks:    len(v.tasks),
-		}
+			Missed:   atomic.LoadUint64(&v.missed),
+			Sent:     atomic.LoadUint64(&v.sent),
+		})
 		return true
 	})
 	return res
 }
 
-// 如果任务队列中已有此任务,则忽略;任务队列中有多个不同的id组,因为对等的datachannel可以同时查询多个视频
+// before 任务a是否应排在b之前:优先级高的在前,其次截止时间早的在前,没有截止时间的排在最后,都相同时保持先来先服务
+func (a *bufferTask) before(b *bufferTask) bool {
+	if a.priority != b.priority {
+		return a.priority > b.priority
+	}
+	if a.deadline.IsZero() || b.deadline.IsZero() {
+		return !a.deadline.IsZero() && b.deadline.IsZero()
+	}
+	return a.deadline.Before(b.deadline)
+}
+
+// expired 截止时间已过
+func (a *bufferTask) expired(now time.Time) bool {
+	return !a.deadline.IsZero() && now.After(a.deadline)
+}
+
+// 如果任务队列中已有此任务,则合并需要发送的分片并取更紧急的优先级和截止时间;任务队列中有多个不同的id组,因为对等的datachannel可以同时查询多个视频
 func (d *dcQueue) addTask(buffer *bufferTask) {
-	var exist = false
-	d.lock.RLock()
+	d.lock.Lock()
+	defer d.lock.Unlock()
 	for _, item := range d.tasks {
 		if buffer.id == item.id && buffer.index == item.index {
-			exist = true
 			buffer.cancel()
+			if buffer.priority > item.priority {
+				item.priority = buffer.priority
+			}
+			if !buffer.deadline.IsZero() && (item.deadline.IsZero() || buffer.deadline.Before(item.deadline)) {
+				item.deadline = buffer.deadline
+			}
+			sort.SliceStable(d.tasks, func(i, j int) bool {
+				return d.tasks[i].before(d.tasks[j])
+			})
+			if item.chunks == nil || buffer.chunks == nil {
+				item.chunks = nil
+				return
+			}
+			for i := range buffer.chunks {
+				item.chunks[i] = true
+			}
+			return
 		}
 	}
-	d.lock.RUnlock()
-	if exist {
-		return
+	// 插入到第一个比它靠后的任务之前
+	var i = sort.Search(len(d.tasks), func(i int) bool {
+		return buffer.before(d.tasks[i])
+	})
+	d.tasks = append(d.tasks, nil)
+	copy(d.tasks[i+1:], d.tasks[i:])
+	d.tasks[i] = buffer
+	select {
+	case d.notify <- struct{}{}:
+	default:
 	}
-	d.lock.Lock()
-	d.tasks = append(d.tasks, buffer)
-	d.lock.Unlock()
 }
 
-// get the first task from array
+// getTask 取出最优先的任务,已过截止时间的任务直接丢弃
 func (d *dcQueue) getTask() *bufferTask {
+	var now = time.Now()
 	d.lock.Lock()
 	defer d.lock.Unlock()
-	var l = len(d.tasks)
-	if l < 1 {
-		return nil
+	for len(d.tasks) > 0 {
+		task := d.tasks[0]
+		d.tasks[0] = nil
+		d.tasks = d.tasks[1:]
+		if task.expired(now) {
+			task.cancel()
+			atomic.AddUint64(&d.missed, 1)
+			continue
+		}
+		return task
 	}
-	task := d.tasks[0]
-	d.tasks = d.tasks[1:]
-	return task
+	return nil
 }
 
 func (d *dcQueue) rmTask(id string, index uint64) {
-	var l = len(d.tasks)
-	if l < 1 {
-		return
-	}
 	d.lock.Lock()
 	defer d.lock.Unlock()
+	if c := d.current; c != nil && ((id == "" && index == 0) || (c.id == id && c.index == index)) {
+		c.cancel()
+	}
+	if len(d.tasks) < 1 {
+		return
+	}
 	if id == "" && index == 0 {
 		// cancel all task
 		for i, x := range d.tasks {
@@ -177,19 +307,24 @@ func (d *dcQueue) quit(id string, index uint64) {
 }
 
 func (d *dcQueue) doTask(task *bufferTask) error {
-	var buffers [][]byte
+	var st *request.Stream
 	select {
 	case <-task.ctx.Done():
 		return nil
 	case <-d.ctx.Done():
 		return nil
 	default:
-		// 因使用了缓存池,bs只读并且需尽快使用,等会过期将会被其他地方复用
-		bs, err := httpProvider.Get(task.target)
-		if err != nil {
+		if task.expired(time.Now()) {
+			// 对方已不再需要此分段,无需再向上游请求
+			atomic.AddUint64(&d.missed, 1)
+			return nil
+		}
+		// 数据来自缓存池,只读,发送完毕释放引用后才会被复用
+		var err error
+		if st, err = openSegment(d.peer, task.id, task.index, task.target); err != nil {
 			return err
 		}
-		buffers = splitBuffer(bs)
+		defer st.Release()
 	}
 	select {
 	case <-task.ctx.Done():
@@ -197,15 +332,29 @@ func (d *dcQueue) doTask(task *bufferTask) error {
 	case <-d.ctx.Done():
 		return nil
 	default:
+		// 分片数量由索引中的字节范围得出,无需等待下载完成
 		var (
 			err    error
-			l      = len(buffers)
-			i      int
+			total  = st.Total()
+			size   = task.caps.Chunk
+			l      = (total + size - 1) / size
 			buffer []byte
-			start  = time.Now()
+			header []byte
+			sum    []byte
+			offset int
+			format = task.caps.Format()
 		)
-		// 为保障buffers尽快去消费,我们限定在5s内使用(但是底层Send仍会引用此数据,实际可能大于此时间),超过这个时间作废
-		for i, buffer = range buffers {
+		// 对方quit或断开时中断正在等待的读取
+		ctx, cancel := context.WithCancel(task.ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-d.ctx.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		for i := 0; i < l; i++ {
 			select {
 			case <-task.ctx.Done():
 				return nil
@@ -215,80 +364,163 @@ func (d *dcQueue) doTask(task *bufferTask) error {
 				if d.dc.ReadyState() != webrtc.DataChannelStateOpen {
 					return nil
 				}
-				err = d.dc.Send(append(chunkHeader(task.id, task.index, i, l), buffer...))
-				if err != nil {
+				var end = offset + size
+				if end > total {
+					end = total
+				}
+				if task.chunks != nil && !task.chunks[i] {
+					// 只补发对方缺失的分片,序号和偏移保持不变
+					offset = end
+					continue
+				}
+				// 上游数据边下载边发送,阻塞到此分片的数据到达;长度与索引不符时读取最后一个分片会出错
+				if buffer, err = st.Read(ctx, offset, end); err != nil {
+					if ctx.Err() != nil {
+						return nil
+					}
+					d.sendError(task, i, l, offset, total)
 					return err
 				}
-				var n = d.dc.BufferedAmount() / maxBufferedAmount
-				if n < 1 {
-					n = 1
+				var f = &frame{
+					id:     task.id,
+					index:  task.index,
+					i:      i,
+					n:      l,
+					offset: offset,
+					total:  total,
 				}
-				time.Sleep(time.Millisecond * time.Duration(100*n))
-			}
-			if time.Since(start) > time.Second*5 {
-				return nil
+				if i == l-1 {
+					// 最后一个分片携带整个分段的sha256,供对方校验组装后的数据,读取到最后一个分片时下载已完成
+					if sum, err = hex.DecodeString(st.Sum()); err != nil {
+						return err
+					}
+					f.sum = sum
+				}
+				if header, err = f.header(format); err != nil {
+					return err
+				}
+				if err = d.waitBuffered(task.ctx); err != nil {
+					return nil
+				}
+				var data = append(header, buffer...)
+				// 由全局调度器决定何时发送,保证各Peer公平分享上传带宽并且不超过限速
+				if err = sched.acquire(task.ctx, d, len(data)); err != nil {
+					return nil
+				}
+				err = d.dc.Send(data)
+				if err != nil {
+					return err
+				}
+				atomic.AddUint64(&d.sent, uint64(len(data)))
+				offset = end
 			}
 		}
 		return err
 	}
 }
 
+// sendError 上游数据有误,已发出的分片不可用,使用二进制头部时发送错误帧通知对方丢弃;旧版头部无法表示,对方收不到最后一个分片也无法完成组装
+func (d *dcQueue) sendError(task *bufferTask, i int, n int, offset int, total int) {
+	if task.caps.Format() != FormatBinary || d.dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return
+	}
+	var f = &frame{
+		id:     task.id,
+		index:  task.index,
+		i:      i,
+		n:      n,
+		offset: offset,
+		total:  total,
+		failed: true,
+	}
+	header, err := f.header(FormatBinary)
+	if err != nil {
+		util.Log.Print(err)
+		return
+	}
+	if err = d.dc.Send(header); err != nil {
+		util.Log.Print(err)
+	}
+}
+
+// waitBuffered 对方接收不及时,DataChannel缓冲超过高水位时阻塞,直到SCTP将其发送到低水位以下
+func (d *dcQueue) waitBuffered(ctx context.Context) error {
+	for d.dc.BufferedAmount() > highWater {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-d.ctx.Done():
+			return d.ctx.Err()
+		case <-d.low:
+		case <-time.After(time.Second):
+			// DataChannel关闭时不会再有通知,定期检查状态
+		}
+		if d.dc.ReadyState() != webrtc.DataChannelStateOpen {
+			return errClosed
+		}
+	}
+	return nil
+}
+
+func (d *dcQueue) setCurrent(task *bufferTask) {
+	d.lock.Lock()
+	d.current = task
+	d.lock.Unlock()
+}
+
 func (d *dcQueue) loopTask() {
 	var task *bufferTask
 	var err error
+	var ticker = time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
-		select {
-		case <-d.ctx.Done():
+		if d.dc.ReadyState() != webrtc.DataChannelStateOpen {
 			return
-		default:
-			var n = d.dc.BufferedAmount() / maxBufferedAmount
-			if n < 1 {
-				n = 1
-			}
-			time.Sleep(time.Second * time.Duration(n))
-			if d.dc.ReadyState() != webrtc.DataChannelStateOpen {
+		}
+		task = d.getTask()
+		if task == nil {
+			select {
+			case <-d.ctx.Done():
 				return
+			case <-d.notify:
+			case <-ticker.C:
 			}
-			task = d.getTask()
-			if task == nil {
-				time.Sleep(time.Second)
-				continue
-			}
-			if err = d.doTask(task); err != nil {
-				util.Log.Print(err)
-			}
-			task = nil
+			continue
+		}
+		atomic.StoreInt32(&d.running, 1)
+		d.setCurrent(task)
+		if err = d.doTask(task); err != nil {
+			util.Log.Print(err)
 		}
+		d.setCurrent(nil)
+		atomic.StoreInt32(&d.running, 0)
+		task = nil
 	}
 }
 
-// 自定义分片协议,前端按照此协议组装,header头必须30字符
-// ["id",i,l]
-// id = vid:itag|index
-func chunkHeader(id string, index uint64, i int, l int) []byte {
-	var header = fmt.Sprintf(`["%s|%d",%d,%d]`, id, index, i, l)
-	return []byte(fmt.Sprintf("%-30s", header))
-}
-
-func splitBuffer(bs []byte) [][]byte {
-	var (
-		buffers = [][]byte{}
-		start   = 0
-		end     = 0
-		l       = len(bs)
-		data    []byte
-	)
-	for {
-		if start >= l {
-			break
+// bufferWaterMarks 读取BUFFER_HIGH和BUFFER_LOW配置,默认1MB和256KB
+func bufferWaterMarks() (uint64, uint64) {
+	var high, low uint64 = 1024 * 1024, 256 * 1024
+	if s := os.Getenv("BUFFER_HIGH"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil || n == 0 {
+			panic(fmt.Errorf("error BUFFER_HIGH %s", s))
 		}
-		end = start + chunk
-		if end > l {
-			end = l
+		high = n
+		if low >= high {
+			low = high / 4
 		}
-		data = bs[start:end]
-		buffers = append(buffers, data)
-		start = end
 	}
-	return buffers
+	if s := os.Getenv("BUFFER_LOW"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil || n >= high {
+			panic(fmt.Errorf("error BUFFER_LOW %s", s))
+		}
+		low = n
+	}
+	return high, low
+}
+
+func badDc(dstatus webrtc.DataChannelState) bool {
+	return dstatus == webrtc.DataChannelStateClosed || dstatus == webrtc.DataChannelStateClosing
 }
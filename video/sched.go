@@ -0,0 +1,276 @@
+package video
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 超过此时间未使用的Peer限速桶会被清理
+const bucketIdle = time.Minute
+
+var sched = newScheduler(envRate("UPLOAD_LIMIT"), envRate("PEER_UPLOAD_LIMIT"))
+
+// UploadStat for scheduler status
+type UploadStat struct {
+	Limit     int    // 总上传速率限制,字节/秒, 0为不限制
+	PeerLimit int    // 每个Peer的上传速率限制,字节/秒, 0为不限制
+	Pending   int    // 等待发送的分片数
+	Sent      uint64 // 已发送的字节数
+}
+
+// bucket 令牌桶,令牌不足时可透支一次,之后需等待补足
+type bucket struct {
+	rate   float64
+	tokens float64
+	time   time.Time
+}
+
+// scheduler 所有发送队列的分片都由此调度,按公平队列(SFQ)轮流发送,各队列按字节平分带宽,并限制总上传速率和每个Peer的上传速率
+type scheduler struct {
+	limit     int
+	peerLimit int
+	global    *bucket
+	peers     map[string]*bucket
+	pending   []*sendRequest
+	vtime     float64 // 最近一次发送的请求的虚拟开始时间
+	sent      uint64
+	wake      chan struct{}
+	lock      *sync.Mutex
+}
+
+type sendRequest struct {
+	q     *dcQueue
+	n     int
+	start float64 // 虚拟开始时间,越小越先发送
+	ready chan struct{}
+}
+
+func envRate(name string) int {
+	var s = os.Getenv(name)
+	if s == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		panic(fmt.Errorf("error %s %s", name, s))
+	}
+	return n
+}
+
+func newBucket(rate int, now time.Time) *bucket {
+	return &bucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		time:   now,
+	}
+}
+
+// wait 还需等待多久才有令牌可用
+func (b *bucket) wait(now time.Time) time.Duration {
+	b.tokens += now.Sub(b.time).Seconds() * b.rate
+	if b.tokens > b.rate {
+		// 最多积攒1秒的令牌
+		b.tokens = b.rate
+	}
+	b.time = now
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *bucket) take(n int) {
+	b.tokens -= float64(n)
+}
+
+func (b *bucket) refund(n int) {
+	b.tokens += float64(n)
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+func newScheduler(limit int, peerLimit int) *scheduler {
+	var s = &scheduler{
+		limit:     limit,
+		peerLimit: peerLimit,
+		peers:     map[string]*bucket{},
+		wake:      make(chan struct{}, 1),
+		lock:      &sync.Mutex{},
+	}
+	if limit > 0 {
+		s.global = newBucket(limit, time.Now())
+	}
+	go s.run()
+	return s
+}
+
+// acquire 申请发送n字节,阻塞到轮到此队列发送,ctx或队列取消时返回错误
+// priority由对方指定,只决定同一队列内的顺序,不影响各队列之间的份额
+func (s *scheduler) acquire(ctx context.Context, q *dcQueue, n int) error {
+	var r = s.enqueue(q, n)
+	select {
+	case <-r.ready:
+		return nil
+	case <-ctx.Done():
+		s.remove(r)
+		return ctx.Err()
+	case <-q.ctx.Done():
+		s.remove(r)
+		return q.ctx.Err()
+	}
+}
+
+// enqueue 加入等待队列并唤醒调度
+func (s *scheduler) enqueue(q *dcQueue, n int) *sendRequest {
+	var r = &sendRequest{
+		q:     q,
+		n:     n,
+		ready: make(chan struct{}),
+	}
+	s.lock.Lock()
+	r.start = q.vtime
+	if r.start < s.vtime {
+		// 空闲过的队列不能用过去积攒的份额插队
+		r.start = s.vtime
+	}
+	s.pending = append(s.pending, r)
+	s.lock.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return r
+}
+
+// remove 取消等待中的请求,若此请求已被选中(ready与取消同时发生)则退还已扣除的令牌
+func (s *scheduler) remove(r *sendRequest) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, item := range s.pending {
+		if item == r {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			return
+		}
+	}
+	if s.global != nil {
+		s.global.refund(r.n)
+	}
+	if b := s.peers[r.q.peer]; b != nil {
+		b.refund(r.n)
+	}
+	if r.q.vtime == r.start+float64(r.n) {
+		r.q.vtime = r.start
+	}
+	s.sent -= uint64(r.n)
+}
+
+func (s *scheduler) run() {
+	var timer = time.NewTimer(time.Hour)
+	for {
+		s.lock.Lock()
+		r, wait := s.pick(time.Now())
+		s.lock.Unlock()
+		if r != nil {
+			close(r.ready)
+			continue
+		}
+		if wait <= 0 {
+			// 没有等待发送的请求
+			wait = time.Hour
+		}
+		timer.Reset(wait)
+		select {
+		case <-s.wake:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-timer.C:
+		}
+	}
+}
+
+// pick 选出虚拟开始时间最小且未超过限速的请求,需持有锁;没有可发送的请求时返回需等待的时间
+func (s *scheduler) pick(now time.Time) (*sendRequest, time.Duration) {
+	if len(s.pending) == 0 {
+		s.cleanPeers(now)
+		return nil, 0
+	}
+	if s.global != nil {
+		if wait := s.global.wait(now); wait > 0 {
+			return nil, wait
+		}
+	}
+	var (
+		index = -1
+		wait  time.Duration
+	)
+	for i, r := range s.pending {
+		if b := s.peerBucket(r.q.peer, now); b != nil {
+			if w := b.wait(now); w > 0 {
+				if wait == 0 || w < wait {
+					wait = w
+				}
+				continue
+			}
+		}
+		if index < 0 || r.start < s.pending[index].start {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, wait
+	}
+	var r = s.pending[index]
+	s.pending = append(s.pending[:index], s.pending[index+1:]...)
+	s.vtime = r.start
+	r.q.vtime = r.start + float64(r.n)
+	if s.global != nil {
+		s.global.take(r.n)
+	}
+	if b := s.peers[r.q.peer]; b != nil {
+		b.take(r.n)
+	}
+	s.sent += uint64(r.n)
+	return r, 0
+}
+
+// peerBucket 未配置每个Peer的限速时返回nil,需持有锁
+func (s *scheduler) peerBucket(peer string, now time.Time) *bucket {
+	if s.peerLimit <= 0 {
+		return nil
+	}
+	b, ok := s.peers[peer]
+	if !ok {
+		b = newBucket(s.peerLimit, now)
+		s.peers[peer] = b
+	}
+	return b
+}
+
+// cleanPeers 清理长时间未使用的Peer限速桶,需持有锁
+func (s *scheduler) cleanPeers(now time.Time) {
+	for peer, b := range s.peers {
+		if now.Sub(b.time) > bucketIdle {
+			delete(s.peers, peer)
+		}
+	}
+}
+
+func (s *scheduler) stats() *UploadStat {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return &UploadStat{
+		Limit:     s.limit,
+		PeerLimit: s.peerLimit,
+		Pending:   len(s.pending),
+		Sent:      s.sent,
+	}
+}
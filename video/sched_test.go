@@ -0,0 +1,178 @@
+package video
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testScheduler 不启动run,由测试直接调用pick
+func testScheduler(limit int, peerLimit int) *scheduler {
+	var s = &scheduler{
+		limit:     limit,
+		peerLimit: peerLimit,
+		peers:     map[string]*bucket{},
+		wake:      make(chan struct{}, 1),
+		lock:      &sync.Mutex{},
+	}
+	if limit > 0 {
+		s.global = newBucket(limit, time.Now())
+	}
+	return s
+}
+
+func testQueue(peer string) *dcQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &dcQueue{
+		peer:   peer,
+		ctx:    ctx,
+		cancel: cancel,
+		lock:   &sync.RWMutex{},
+	}
+}
+
+func TestBucketWait(t *testing.T) {
+	var now = time.Now()
+	var b = newBucket(100, now)
+	if w := b.wait(now); w != 0 {
+		t.Fatalf("wait %s, expected 0", w)
+	}
+	b.take(150)
+	if w := b.wait(now); w != time.Millisecond*500 {
+		t.Fatalf("wait %s, expected 500ms", w)
+	}
+	if w := b.wait(now.Add(time.Millisecond * 500)); w != 0 {
+		t.Fatalf("wait %s, expected 0", w)
+	}
+	// 最多积攒1秒的令牌
+	b.wait(now.Add(time.Hour))
+	if b.tokens != 100 {
+		t.Fatalf("tokens %f, expected 100", b.tokens)
+	}
+}
+
+func TestSchedulerRefundPicked(t *testing.T) {
+	var (
+		s   = testScheduler(1000, 1000)
+		q   = testQueue("a")
+		now = time.Now()
+	)
+	var r = s.enqueue(q, 600)
+	s.lock.Lock()
+	picked, _ := s.pick(now)
+	s.lock.Unlock()
+	if picked != r {
+		t.Fatal("request not picked")
+	}
+	if s.global.tokens != 400 || s.peers["a"].tokens != 400 || s.sent != 600 {
+		t.Fatalf("tokens %f %f sent %d after pick", s.global.tokens, s.peers["a"].tokens, s.sent)
+	}
+	// ready与ctx取消同时发生,已扣除的令牌需退还
+	s.remove(r)
+	if s.global.tokens != 1000 || s.peers["a"].tokens != 1000 || s.sent != 0 {
+		t.Fatalf("tokens %f %f sent %d after refund", s.global.tokens, s.peers["a"].tokens, s.sent)
+	}
+	if q.vtime != r.start {
+		t.Fatalf("vtime %f, expected %f", q.vtime, r.start)
+	}
+}
+
+func TestSchedulerRemovePending(t *testing.T) {
+	var (
+		s = testScheduler(1000, 0)
+		q = testQueue("a")
+	)
+	var r = s.enqueue(q, 600)
+	s.remove(r)
+	if len(s.pending) != 0 || s.global.tokens != 1000 {
+		t.Fatalf("pending %d tokens %f", len(s.pending), s.global.tokens)
+	}
+}
+
+func TestAcquireCanceled(t *testing.T) {
+	var (
+		s = newScheduler(100, 0)
+		q = testQueue("a")
+	)
+	s.lock.Lock()
+	s.global.take(1000)
+	s.lock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := s.acquire(ctx, q, 10); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err %v, expected deadline exceeded", err)
+	}
+	if st := s.stats(); st.Pending != 0 || st.Sent != 0 {
+		t.Fatalf("pending %d sent %d", st.Pending, st.Sent)
+	}
+	q.cancel()
+	if err := s.acquire(context.Background(), q, 10); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err %v, expected canceled", err)
+	}
+}
+
+// share 每个队列始终有一个等待中的请求,返回各队列发送的字节数
+func share(s *scheduler, queues map[*dcQueue]int, rounds int) map[*dcQueue]int {
+	var (
+		sent    = map[*dcQueue]int{}
+		pending = map[*sendRequest]*dcQueue{}
+	)
+	for q, n := range queues {
+		pending[s.enqueue(q, n)] = q
+	}
+	for i := 0; i < rounds; i++ {
+		s.lock.Lock()
+		r, _ := s.pick(time.Now())
+		s.lock.Unlock()
+		var q = pending[r]
+		delete(pending, r)
+		sent[q] += r.n
+		pending[s.enqueue(q, queues[q])] = q
+	}
+	return sent
+}
+
+func TestSchedulerEqualShare(t *testing.T) {
+	var (
+		s = testScheduler(0, 0)
+		a = testQueue("a")
+		b = testQueue("b")
+	)
+	// 分片大小不同的队列按字节平分带宽
+	var sent = share(s, map[*dcQueue]int{a: 1000, b: 250}, 500)
+	if d := sent[a] - sent[b]; d > 1000 || d < -1000 {
+		t.Fatalf("sent a %d b %d", sent[a], sent[b])
+	}
+}
+
+func TestSchedulerPeerLimit(t *testing.T) {
+	var (
+		s   = testScheduler(0, 1000)
+		a   = testQueue("a")
+		b   = testQueue("b")
+		now = time.Now()
+	)
+	var ra = s.enqueue(a, 1500)
+	s.lock.Lock()
+	if r, _ := s.pick(now); r != ra {
+		t.Fatal("first request not picked")
+	}
+	s.lock.Unlock()
+	// a已透支,只能发送b的请求
+	ra = s.enqueue(a, 100)
+	var rb = s.enqueue(b, 100)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if r, _ := s.pick(now); r != rb {
+		t.Fatal("request of b not picked")
+	}
+	r, wait := s.pick(now)
+	if r != nil || wait != time.Millisecond*500 {
+		t.Fatalf("picked %v wait %s, expected 500ms", r, wait)
+	}
+	if r, _ = s.pick(now.Add(wait)); r != ra {
+		t.Fatal("request of a not picked after wait")
+	}
+}
@@ -2,11 +2,15 @@ package video
 
 import (
 	"context"
+	"errors"
 	"os"
+	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"videortc/request"
+	"videortc/store"
 	"videortc/util"
 
 	"github.com/pion/webrtc/v3"
@@ -18,10 +22,21 @@ import (
 var (
 	videoClient = vutil.MakeClient("VIDEO_PROXY", time.Second*5)
 	baseURL     = os.Getenv("BASE_URL")
+	// ErrInvalidID 请求的id格式错误,正常的客户端不会发出
+	ErrInvalidID = errors.New("invalid id")
+	// ErrNotFound 请求的id不是有效的媒体资源
+	ErrNotFound = errors.New("resource not found")
+	// ErrUnavailable 获取视频信息失败,可能是上游暂时不可用,不缓存此结果
+	ErrUnavailable = errors.New("resource unavailable")
+	// ErrDraining 正在停止服务,不再接受新任务
+	ErrDraining = errors.New("draining")
+	// id形式为 vid:itag
+	idReg = regexp.MustCompile(`^[\w-]{11}:\d{1,4}$`)
 )
 
 type videoItem struct {
 	vinfo  *youtubevideoparser.VideoInfo
+	err    error
 	time   time.Time
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -29,23 +44,43 @@ type videoItem struct {
 
 // MediaHub manage all videos
 type MediaHub struct {
-	videos sync.Map
-	time   time.Time
+	videos   sync.Map
+	time     time.Time
+	draining int32
 }
 
 type bufferTask struct {
-	id     string
-	index  uint64
-	target string
-	ctx    context.Context
-	cancel context.CancelFunc
+	id       string
+	index    uint64
+	target   *request.Target
+	caps     *Caps
+	chunks   map[int]bool // 只发送这些分片,nil则发送全部
+	priority int
+	deadline time.Time // 零值表示没有截止时间
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// Resolve 对方请求发送的分段
+type Resolve struct {
+	Peer   string // 对方的Peer ID
+	ID     string
+	Index  uint64
+	Caps   *Caps // 与对方协商后的能力
+	Chunks []int // 只发送这些分片(用于补发丢失的分片),为空则发送全部
+	// Priority 越大越优先, Deadline 对方播放需要此分段的时间,过期的任务不再发送
+	Priority int
+	Deadline time.Time
 }
 
 // VStatus for status info
 type VStatus struct {
-	Time   time.Time
-	Videos map[string]*youtubevideoparser.VideoInfo
-	Queues map[string]*ItemStat
+	Time     time.Time
+	Videos   map[string]*youtubevideoparser.VideoInfo
+	Queues   map[string][]*ItemStat // Peer ID => 此Peer的发送队列
+	Upload   *UploadStat
+	Store    *store.Stat
+	Prefetch *PrefetchStat
 }
 
 // NewMediaHub create MediaHub
@@ -68,15 +103,16 @@ func itemValid(item *youtubevideoparser.StreamItem) bool {
 
 // Ok test if this resource ok
 func (m *MediaHub) Ok(id string) bool {
-	_, item := m.getVideoInfo(id)
-	return itemValid(item)
+	_, _, err := m.getVideoInfo(id)
+	return err == nil
 }
 
-func (m *MediaHub) getVideoInfo(id string) (*youtubevideoparser.VideoInfo, *youtubevideoparser.StreamItem) {
-	var arr = strings.Split(id, ":")
-	if len(arr) != 2 {
-		return nil, nil
+// getVideoInfo id格式错误返回ErrInvalidID,获取失败返回ErrUnavailable,资源不存在返回ErrNotFound
+func (m *MediaHub) getVideoInfo(id string) (*youtubevideoparser.VideoInfo, *youtubevideoparser.StreamItem, error) {
+	if !idReg.MatchString(id) {
+		return nil, nil, ErrInvalidID
 	}
+	var arr = strings.Split(id, ":")
 	var (
 		vid   = arr[0]
 		itag  = arr[1]
@@ -95,22 +131,33 @@ func (m *MediaHub) getVideoInfo(id string) (*youtubevideoparser.VideoInfo, *yout
 	if loaded {
 		// 说明已存在此任务,我们只需要监听此任务是否已完成(或早已经完成),完成的任务我们获取其属性就好了
 		<-info.ctx.Done()
-		if info.vinfo == nil || info.vinfo.Streams == nil {
-			return nil, nil
-		}
-		return info.vinfo, info.vinfo.Streams[itag]
+		return streamItem(info, itag)
 	}
 	// 否则此任务没有并发,我们第一个执行,需要正常执行然后设置其属性,并标记已执行完成
 	vinfo, err = getInfo(vid)
-	if err != nil {
-		util.Log.Print(err)
+	if err != nil || vinfo == nil {
+		util.Log.Print(vid, err)
+		info.err = ErrUnavailable
+		// 失败的结果不缓存,下次请求重新获取
+		m.videos.Delete(vid)
 	}
 	info.vinfo = vinfo
 	cancel()
-	if vinfo == nil || vinfo.Streams == nil {
-		return nil, nil
+	return streamItem(info, itag)
+}
+
+func streamItem(info *videoItem, itag string) (*youtubevideoparser.VideoInfo, *youtubevideoparser.StreamItem, error) {
+	if info.err != nil {
+		return nil, nil, info.err
 	}
-	return vinfo, vinfo.Streams[itag]
+	if info.vinfo.Streams == nil {
+		return nil, nil, ErrNotFound
+	}
+	var item = info.vinfo.Streams[itag]
+	if !itemValid(item) {
+		return nil, nil, ErrNotFound
+	}
+	return info.vinfo, item, nil
 }
 
 func (m *MediaHub) clean() {
@@ -137,33 +184,117 @@ func getInfo(id string) (*youtubevideoparser.VideoInfo, error) {
 }
 
 // Response create send task that send data to dc
-func (m *MediaHub) Response(d *webrtc.DataChannel, id string, index uint64) error {
-	vinfo, item := m.getVideoInfo(id)
-	if !itemValid(item) {
-		return nil
+func (m *MediaHub) Response(d *webrtc.DataChannel, r *Resolve) error {
+	if atomic.LoadInt32(&m.draining) == 1 {
+		return ErrDraining
 	}
-	target, err := request.GetIndex(vinfo.ID, item, int(index))
+	vinfo, item, err := m.getVideoInfo(r.ID)
 	if err != nil {
 		return err
 	}
+	target, err := request.GetIndex(vinfo.ID, item, int(r.Index))
+	if err != nil {
+		return err
+	}
+	var chunks map[int]bool
+	if len(r.Chunks) > 0 {
+		chunks = map[int]bool{}
+		for _, i := range r.Chunks {
+			chunks[i] = true
+		}
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
-	queueManager.send(d, &bufferTask{
-		id,
-		index,
-		target,
-		ctx,
-		cancel,
+	queueManager.send(r.Peer, d, &bufferTask{
+		id:       r.ID,
+		index:    r.Index,
+		target:   target,
+		caps:     r.Caps,
+		chunks:   chunks,
+		priority: r.Priority,
+		deadline: r.Deadline,
+		ctx:      ctx,
+		cancel:   cancel,
 	})
+	prefetch.start(r.Peer, r.ID, vinfo.ID, item, r.Index)
 	return nil
 }
 
 // QuitResponse cancel that send task
-func (m *MediaHub) QuitResponse(d *webrtc.DataChannel, id string, index uint64) error {
-	queueManager.quit(d, id, index)
+func (m *MediaHub) QuitResponse(peer string, d *webrtc.DataChannel, id string, index uint64) error {
+	queueManager.quit(peer, d, id, index)
+	prefetch.cancel(peer, id)
 	m.clean()
 	return nil
 }
 
+// CancelPeer 对方已断开,取消其发送任务和预取
+func (m *MediaHub) CancelPeer(peer string) {
+	queueManager.cancelPeer(peer)
+	prefetch.cancel(peer, "")
+}
+
+// Sum 已缓存分段的sha256和字节数,未缓存时返回空
+func (m *MediaHub) Sum(id string, index uint64) (string, int) {
+	vinfo, item, err := m.getVideoInfo(id)
+	if err != nil {
+		return "", 0
+	}
+	target := request.CachedIndex(vinfo.ID, item, int(index))
+	if target == nil {
+		return "", 0
+	}
+	sum := cachedSum(id, index, target)
+	if sum == "" {
+		return "", 0
+	}
+	return sum, target.Size
+}
+
+// Availability 批量查询分段状态,返回两个位图,第k位对应indexes[k](每字节低位在前)
+// ready 已在缓存中可立即发送, fetch 索引中存在此分段可从上游获取
+func (m *MediaHub) Availability(id string, indexes []uint64) ([]byte, []byte, error) {
+	var (
+		ready = make([]byte, (len(indexes)+7)/8)
+		fetch = make([]byte, (len(indexes)+7)/8)
+	)
+	vinfo, item, err := m.getVideoInfo(id)
+	if err != nil {
+		return ready, fetch, nil
+	}
+	targets, err := request.GetIndexes(vinfo.ID, item, indexes)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, target := range targets {
+		if target == nil {
+			continue
+		}
+		fetch[k/8] |= 1 << (k % 8)
+		if cachedSum(id, indexes[k], target) != "" {
+			ready[k/8] |= 1 << (k % 8)
+		}
+	}
+	return ready, fetch, nil
+}
+
+// Drain 不再接受新任务,等待队列中的任务发送完毕,超时则取消剩余任务
+func (m *MediaHub) Drain(ctx context.Context) error {
+	atomic.StoreInt32(&m.draining, 1)
+	var ticker = time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
+	for {
+		if queueManager.idle() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			queueManager.cancelAll()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
 // Stats output status
 func (m *MediaHub) Stats() *VStatus {
 	var res = map[string]*youtubevideoparser.VideoInfo{}
@@ -174,8 +305,11 @@ func (m *MediaHub) Stats() *VStatus {
 	})
 	queueStat := queueManager.stats()
 	return &VStatus{
-		Time:   m.time,
-		Videos: res,
-		Queues: queueStat,
+		Time:     m.time,
+		Videos:   res,
+		Queues:   queueStat,
+		Upload:   sched.stats(),
+		Store:    storeStats(),
+		Prefetch: prefetch.stats(),
 	}
 }
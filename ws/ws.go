@@ -1,6 +1,7 @@
 package ws
 
 import (
+	"sync/atomic"
 	"time"
 
 	"videortc/util"
@@ -38,6 +39,7 @@ type Peer struct {
 	onlineMsg    chan *OnlineEvent
 	userMsg      chan *MsgEvent
 	send         chan map[string]interface{}
+	closed       int32
 }
 
 // Loop msg
@@ -108,8 +110,21 @@ func (p *Peer) Send(data map[string]interface{}) {
 	p.send <- data
 }
 
+// Close 关闭ws连接,并且不再重连
+func (p *Peer) Close() error {
+	atomic.StoreInt32(&p.closed, 1)
+	var c = p.conn
+	if c == nil {
+		return nil
+	}
+	if err := c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second)); err != nil {
+		util.Log.Print(err)
+	}
+	return c.Close()
+}
+
 func (p *Peer) connLoop(addr string) {
-	for {
+	for atomic.LoadInt32(&p.closed) == 0 {
 		util.Log.Print(p.wsMsgLoop(addr))
 		time.Sleep(time.Second)
 	}